@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// closeDenied is the access log reason for clients turned away by the allow
+// and deny lists.
+const closeDenied = "denied"
+
+// parseCIDRs parses allow or deny list entries. A bare IP address matches
+// just that address.
+func parseCIDRs(specs []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, spec := range specs {
+		if addr, err := netip.ParseAddr(spec); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR or IP address %q", spec)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// allows reports whether a client may connect. Deny entries win; when there
+// are allow entries the client must also match one of them.
+func (c ProxyConfig) allows(addr net.Addr) bool {
+	if len(c.Allow) == 0 && len(c.Deny) == 0 {
+		return true
+	}
+
+	var ip netip.Addr
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, _ = netip.AddrFromSlice(a.IP)
+	case *net.UDPAddr:
+		ip, _ = netip.AddrFromSlice(a.IP)
+	default:
+		ap, err := netip.ParseAddrPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = ap.Addr()
+	}
+	ip = ip.Unmap()
+
+	for _, prefix := range c.Deny {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	if len(c.Allow) == 0 {
+		return true
+	}
+	for _, prefix := range c.Allow {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// reject counts a TCP client turned away by the allow and deny lists.
+// Dropped UDP datagrams are only counted, since they would flood the logs.
+func (pm *ProxyManager) reject(rp *runningProxy, client net.Addr) {
+	key := rp.cfg.Key()
+	pm.UpdateStats(key, "rejected", int64(1))
+	slog.Warn("Rejected client not allowed by access lists", "proxy", key, "client", client)
+
+	if pm.accessLog != nil {
+		now := time.Now()
+		pm.accessLog.write(accessLogEntry{
+			Port:     rp.cfg.Port,
+			Protocol: rp.cfg.Protocol,
+			Client:   client.String(),
+			Start:    now,
+			End:      now,
+			Reason:   closeDenied,
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		want    []netip.Prefix
+		wantErr string
+	}{
+		{name: "empty"},
+		{
+			name:  "bare addresses match just themselves",
+			specs: []string{"10.0.0.1", "fd7a::1"},
+			want:  []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32"), netip.MustParsePrefix("fd7a::1/128")},
+		},
+		{
+			name:  "prefixes are masked",
+			specs: []string{"100.64.1.2/10", "fd7a:115c:a1e0::5/48"},
+			want:  []netip.Prefix{netip.MustParsePrefix("100.64.0.0/10"), netip.MustParsePrefix("fd7a:115c:a1e0::/48")},
+		},
+		{
+			name:    "hostname",
+			specs:   []string{"10.0.0.0/8", "db.internal"},
+			wantErr: `invalid CIDR or IP address "db.internal"`,
+		},
+		{
+			name:    "prefix too long",
+			specs:   []string{"10.0.0.0/33"},
+			wantErr: `invalid CIDR or IP address "10.0.0.0/33"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCIDRs(tt.specs)
+			msg := ""
+			if err != nil {
+				msg = err.Error()
+			}
+			if msg != tt.wantErr {
+				t.Errorf("error = %q, want %q", msg, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("prefixes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllows(t *testing.T) {
+	prefixes := func(specs ...string) []netip.Prefix {
+		p, err := parseCIDRs(specs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	tcp := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000} }
+	udp := func(ip string) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: 40000} }
+	pipe, _ := net.Pipe()
+	defer pipe.Close()
+
+	tests := []struct {
+		name   string
+		allow  []netip.Prefix
+		deny   []netip.Prefix
+		client net.Addr
+		want   bool
+	}{
+		{name: "no lists", client: tcp("203.0.113.7"), want: true},
+		{name: "no lists, unknown address", client: pipe.RemoteAddr(), want: true},
+		{name: "allowed", allow: prefixes("100.64.0.0/10"), client: tcp("100.100.1.1"), want: true},
+		{name: "not allowed", allow: prefixes("100.64.0.0/10"), client: tcp("203.0.113.7"), want: false},
+		{name: "denied", deny: prefixes("203.0.113.7"), client: tcp("203.0.113.7"), want: false},
+		{name: "not denied", deny: prefixes("203.0.113.7"), client: tcp("203.0.113.8"), want: true},
+		{name: "deny wins over allow", allow: prefixes("10.0.0.0/8"), deny: prefixes("10.0.0.0/24"), client: tcp("10.0.0.5"), want: false},
+		{name: "allowed outside the denied range", allow: prefixes("10.0.0.0/8"), deny: prefixes("10.0.0.0/24"), client: tcp("10.0.1.5"), want: true},
+		{name: "udp client", allow: prefixes("192.168.0.0/16"), client: udp("192.168.4.4"), want: true},
+		{name: "ipv6 client", allow: prefixes("fd7a:115c:a1e0::/48"), client: tcp("fd7a:115c:a1e0::9"), want: true},
+		{name: "ipv4-mapped client", allow: prefixes("127.0.0.1"), client: tcp("::ffff:127.0.0.1"), want: true},
+		{name: "ipv4 rule against ipv6 client", allow: prefixes("0.0.0.0/0"), client: tcp("::1"), want: false},
+		{name: "unknown address with lists", allow: prefixes("0.0.0.0/0"), client: pipe.RemoteAddr(), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ProxyConfig{Allow: tt.allow, Deny: tt.deny}
+			if got := cfg.allows(tt.client); got != tt.want {
+				t.Errorf("allows(%v) = %v, want %v", tt.client, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reasons a connection ended, as written to the access log.
+const (
+	closeClient   = "client_closed"
+	closeUpstream = "upstream_closed"
+	closeIdle     = "idle_timeout"
+	closeKilled   = "killed"
+	closeStopped  = "proxy_stopped"
+	closeLimit    = "limit_reached"
+	closeDial     = "dial_failed"
+	closeError    = "error"
+)
+
+// copyEndReason explains why copying one direction of a connection stopped.
+// side is the reason to give when the reader simply reached EOF. The error is
+// only passed on when it is the reason. An empty reason means the connection
+// was closed from our side, by a caller that has already recorded why.
+func copyEndReason(side string, err error) (string, error) {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return side, nil
+	case errors.Is(err, net.ErrClosed):
+		return "", nil
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return closeIdle, nil
+	default:
+		return closeError, err
+	}
+}
+
+// accessLogEntry is one line of the access log, written when a connection
+// or UDP session ends.
+type accessLogEntry struct {
+	ID       uint64    `json:"id,omitempty"`
+	Port     string    `json:"port"`
+	Protocol string    `json:"protocol"`
+	Client   string    `json:"client"`
+	Upstream string    `json:"upstream,omitempty"`
+	Peer     string    `json:"peer,omitempty"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Duration float64   `json:"duration_seconds"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+	Reason   string    `json:"reason"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// accessLog appends JSON lines to a file, rotating it once it would grow past
+// maxSize. Rotated files are kept as path.1 (the newest) up to path.<backups>.
+type accessLog struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openAccessLog(path string, maxSize int64, backups int) (*accessLog, error) {
+	l := &accessLog{path: path, maxSize: maxSize, backups: backups}
+	if err := l.open(os.O_APPEND); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *accessLog) open(flag int) error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|flag, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open access log: %v", err)
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+func (l *accessLog) write(entry accessLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("Failed to encode access log entry", "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			slog.Error("Failed to rotate access log", "error", err)
+		}
+	}
+	if l.file == nil {
+		return
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		slog.Error("Failed to write access log", "error", err)
+	}
+}
+
+// rotate shifts the backups up by one, moves the current file to path.1 and
+// starts a new one. With no backups the file is simply truncated.
+func (l *accessLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	if l.backups > 0 {
+		for i := l.backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		if err := os.Rename(l.path, l.path+".1"); err != nil {
+			// Keep logging to the oversized file rather than losing entries
+			if reopenErr := l.open(os.O_APPEND); reopenErr != nil {
+				return reopenErr
+			}
+			return err
+		}
+	}
+	return l.open(os.O_TRUNC)
+}
+
+func (l *accessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// logConn writes the access log entry for a TCP connection that has ended.
+func (pm *ProxyManager) logConn(rp *runningProxy, conn *proxyConn) {
+	if pm.accessLog == nil {
+		return
+	}
+
+	conn.mu.Lock()
+	upstream, peer, reason, err := conn.upstreamAddr, conn.peer, conn.reason, conn.err
+	conn.mu.Unlock()
+
+	end := time.Now()
+	entry := accessLogEntry{
+		ID:       conn.id,
+		Port:     rp.cfg.Port,
+		Protocol: rp.cfg.Protocol,
+		Client:   conn.client.RemoteAddr().String(),
+		Upstream: upstream,
+		Peer:     peer,
+		Start:    conn.started,
+		End:      end,
+		Duration: end.Sub(conn.started).Seconds(),
+		BytesIn:  conn.bytesIn.Load(),
+		BytesOut: conn.bytesOut.Load(),
+		Reason:   reason,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	pm.accessLog.write(entry)
+}
+
+// logSession writes the access log entry for a UDP session that has ended.
+func (r *udpRelay) logSession(client string, s *udpSession, reason string, err error) {
+	if r.pm.accessLog == nil {
+		return
+	}
+
+	end := time.Now()
+	entry := accessLogEntry{
+		Port:     r.port,
+		Protocol: "udp",
+		Client:   client,
+		Upstream: r.targetAddr,
+		Start:    s.started,
+		End:      end,
+		Duration: end.Sub(s.started).Seconds(),
+		BytesIn:  s.bytesIn.Load(),
+		BytesOut: s.bytesOut.Load(),
+		Reason:   reason,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	r.pm.accessLog.write(entry)
+}
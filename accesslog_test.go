@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogRotation(t *testing.T) {
+	entry := accessLogEntry{
+		Port:     "5432",
+		Protocol: "tcp",
+		Client:   "100.100.1.1:40000",
+		Start:    time.Unix(1700000000, 0).UTC(),
+		End:      time.Unix(1700000001, 0).UTC(),
+		Duration: 1,
+		Reason:   closeClient,
+	}
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := int64(len(encoded) + 1)
+
+	tests := []struct {
+		name     string
+		maxSize  int64
+		backups  int
+		existing int // lines already in the file when it is opened
+		writes   int
+		want     []int // lines in path, path.1, path.2, ...; later files must not exist
+	}{
+		{name: "no limit", maxSize: 0, backups: 2, writes: 5, want: []int{5}},
+		{name: "exactly full", maxSize: 2 * line, backups: 2, writes: 2, want: []int{2}},
+		{name: "next line rotates", maxSize: 2 * line, backups: 2, writes: 3, want: []int{1, 2}},
+		{name: "one byte short", maxSize: 2*line - 1, backups: 2, writes: 2, want: []int{1, 1}},
+		{name: "backups shift", maxSize: 2 * line, backups: 2, writes: 6, want: []int{2, 2, 2}},
+		{name: "oldest backup dropped", maxSize: 2 * line, backups: 2, writes: 8, want: []int{2, 2, 2}},
+		{name: "no backups truncates", maxSize: 2 * line, backups: 0, writes: 3, want: []int{1}},
+		{name: "line larger than the limit", maxSize: line / 2, backups: 3, writes: 3, want: []int{1, 1, 1}},
+		{name: "existing file counts", maxSize: 2 * line, backups: 1, existing: 2, writes: 1, want: []int{1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			if tt.existing > 0 {
+				existing := strings.Repeat(string(encoded)+"\n", tt.existing)
+				if err := os.WriteFile(path, []byte(existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			l, err := openAccessLog(path, tt.maxSize, tt.backups)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < tt.writes; i++ {
+				l.write(entry)
+			}
+			if err := l.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i <= len(tt.want); i++ {
+				name := path
+				if i > 0 {
+					name = fmt.Sprintf("%s.%d", path, i)
+				}
+				data, err := os.ReadFile(name)
+				if i == len(tt.want) {
+					if err == nil {
+						t.Errorf("%s exists, want at most %d backups", filepath.Base(name), len(tt.want)-1)
+					}
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.maxSize > 0 && int64(len(data)) > max(tt.maxSize, line) {
+					t.Errorf("%s is %d bytes, limit %d", filepath.Base(name), len(data), tt.maxSize)
+				}
+				if got := strings.Count(string(data), "\n"); got != tt.want[i] {
+					t.Errorf("%s has %d lines, want %d", filepath.Base(name), got, tt.want[i])
+				}
+			}
+		})
+	}
+}
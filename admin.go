@@ -0,0 +1,632 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ConnInfo describes a live client connection.
+type ConnInfo struct {
+	ID       uint64
+	Proxy    string // key of the proxy that accepted it
+	Client   string
+	Upstream string // empty while the upstream is still being dialed
+	Peer     string // the other instance's tunnel certificate name, if any
+	Started  time.Time
+
+	BytesIn      int64 // client to upstream
+	BytesOut     int64 // upstream to client
+	LastActivity time.Time
+}
+
+// proxies returns every started proxy, including ones still draining.
+func (pm *ProxyManager) proxies() []*runningProxy {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	proxies := make([]*runningProxy, 0, len(pm.running)+len(pm.draining))
+	for _, rp := range pm.running {
+		proxies = append(proxies, rp)
+	}
+	for rp := range pm.draining {
+		proxies = append(proxies, rp)
+	}
+	return proxies
+}
+
+// Connections lists the live TCP connections of every proxy, oldest first.
+// With key set only that proxy's connections are listed.
+func (pm *ProxyManager) Connections(key string) []ConnInfo {
+	var conns []ConnInfo
+	for _, rp := range pm.proxies() {
+		if key != "" && rp.cfg.Key() != key {
+			continue
+		}
+
+		rp.mu.Lock()
+		for conn := range rp.conns {
+			conns = append(conns, conn.info(rp.cfg.Key()))
+		}
+		rp.mu.Unlock()
+	}
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+func (c *proxyConn) info(key string) ConnInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return ConnInfo{
+		ID:       c.id,
+		Proxy:    key,
+		Client:   c.client.RemoteAddr().String(),
+		Upstream: c.upstreamAddr,
+		Peer:     c.peer,
+		Started:  c.started,
+
+		BytesIn:      c.bytesIn.Load(),
+		BytesOut:     c.bytesOut.Load(),
+		LastActivity: time.Unix(0, c.lastActivity.Load()),
+	}
+}
+
+// CloseConnection force-closes the connection with the given ID and reports
+// whether it was found.
+func (pm *ProxyManager) CloseConnection(id uint64) bool {
+	for _, rp := range pm.proxies() {
+		rp.mu.Lock()
+		var found *proxyConn
+		for conn := range rp.conns {
+			if conn.id == id {
+				found = conn
+				break
+			}
+		}
+		rp.mu.Unlock()
+
+		if found != nil {
+			found.closeWith(closeKilled)
+			return true
+		}
+	}
+	return false
+}
+
+// AddProxy starts a proxy that isn't in the config file. It keeps running
+// across reloads unless the file gains an entry for the same port.
+func (pm *ProxyManager) AddProxy(cfg ProxyConfig) error {
+	if cfg.Protocol == "" {
+		cfg.Protocol = "tcp"
+	}
+	if cfg.TargetPort == "" {
+		cfg.TargetPort = cfg.Port
+	}
+	if !validPort(cfg.Port) {
+		return fmt.Errorf("invalid port %q", cfg.Port)
+	}
+	if !validPort(cfg.TargetPort) {
+		return fmt.Errorf("invalid target port %q", cfg.TargetPort)
+	}
+	if cfg.Protocol != "tcp" && cfg.Protocol != "udp" {
+		return fmt.Errorf("unsupported protocol %q", cfg.Protocol)
+	}
+
+	pm.changes.Lock()
+	defer pm.changes.Unlock()
+
+	if pm.closing {
+		return errShuttingDown
+	}
+
+	resolved, err := pm.resolveHosts([]ProxyConfig{cfg})
+	if err != nil {
+		return err
+	}
+	cfg = resolved[0]
+
+	key := cfg.Key()
+	pm.mu.Lock()
+	_, exists := pm.running[key]
+	if !exists {
+		pm.dynamic[key] = cfg
+	}
+	pm.mu.Unlock()
+	if exists {
+		return fmt.Errorf("port %s is already proxied", key)
+	}
+
+	pm.startProxy(cfg)
+	pm.addEvent(false, "Started port %s through the admin API", key)
+	return nil
+}
+
+// RemoveProxy stops the proxy for key and lets its connections drain. A
+// proxy from the config file comes back the next time the file is reloaded.
+// The proxy given on the command line stays, as the process exits without it.
+func (pm *ProxyManager) RemoveProxy(key string) error {
+	pm.changes.Lock()
+	defer pm.changes.Unlock()
+
+	if pm.closing {
+		return errShuttingDown
+	}
+	if pm.single {
+		return errSingleProxy
+	}
+
+	pm.mu.Lock()
+	_, exists := pm.running[key]
+	delete(pm.dynamic, key)
+	pm.mu.Unlock()
+	if !exists {
+		return errNoProxy
+	}
+
+	pm.stopProxy(key, true)
+	pm.addEvent(false, "Stopped port %s through the admin API", key)
+	return nil
+}
+
+// RestartProxy closes the listener for key and starts it again with the same
+// settings. Open connections finish on the old listener's behalf.
+func (pm *ProxyManager) RestartProxy(key string) error {
+	pm.changes.Lock()
+	defer pm.changes.Unlock()
+
+	if pm.closing {
+		return errShuttingDown
+	}
+	if pm.single {
+		return errSingleProxy
+	}
+
+	pm.mu.RLock()
+	rp, exists := pm.running[key]
+	pm.mu.RUnlock()
+	if !exists {
+		return errNoProxy
+	}
+
+	pm.stopProxy(key, false)
+	pm.startProxy(rp.cfg)
+	pm.addEvent(false, "Restarted port %s through the admin API", key)
+	return nil
+}
+
+// Failback moves a failover proxy back to the earliest healthy upstream
+// before the one serving, which is how proxies with failback: manual return
+// to the primary. It returns the upstream now serving.
+func (pm *ProxyManager) Failback(key string) (string, error) {
+	pm.mu.RLock()
+	rp, exists := pm.running[key]
+	pm.mu.RUnlock()
+	if !exists {
+		return "", errNoProxy
+	}
+	if rp.cfg.Balance != "failover" {
+		return "", fmt.Errorf("port %s doesn't use failover balancing", key)
+	}
+
+	rp.mu.Lock()
+	if rp.serving == 0 {
+		rp.mu.Unlock()
+		return "", fmt.Errorf("port %s is already served by its primary", key)
+	}
+	next := -1
+	for i, u := range rp.upstreams[:rp.serving] {
+		if u.healthy.Load() {
+			next = i
+			break
+		}
+	}
+	if next == -1 {
+		current := rp.upstreams[rp.serving].addr
+		rp.mu.Unlock()
+		return "", fmt.Errorf("no upstream before %s is healthy", current)
+	}
+	rp.serving = next
+	to := rp.upstreams[next].addr
+	rp.mu.Unlock()
+
+	pm.mu.Lock()
+	rp.stats.Serving = to
+	pm.mu.Unlock()
+	pm.addEvent(false, "Port %s failed back to %s through the admin API", key, to)
+	return to, nil
+}
+
+var (
+	errNoProxy      = errors.New("no such proxy")
+	errShuttingDown = errors.New("shutting down")
+	errSingleProxy  = errors.New("the proxy given on the command line can't be removed or restarted")
+)
+
+// proxyInfo is the JSON form of a proxy's stats.
+type proxyInfo struct {
+	Key               string         `json:"key"`
+	Port              string         `json:"port"`
+	TargetPort        string         `json:"target_port"`
+	Protocol          string         `json:"protocol"`
+	Host              string         `json:"host,omitempty"`
+	Description       string         `json:"description"`
+	Tags              []string       `json:"tags,omitempty"`
+	Status            string         `json:"status"`
+	LocalAddr         string         `json:"local_addr"`
+	RemoteAddr        string         `json:"remote_addr"`
+	ActiveConnections int64          `json:"active_connections"`
+	TotalConnections  int64          `json:"total_connections"`
+	BytesIn           int64          `json:"bytes_in"`
+	BytesOut          int64          `json:"bytes_out"`
+	RateIn            float64        `json:"rate_in"`  // bytes per second
+	RateOut           float64        `json:"rate_out"` // bytes per second
+	Datagrams         int64          `json:"datagrams,omitempty"`
+	Rejected          int64          `json:"rejected"`
+	TLS               bool           `json:"tls"`
+	TLSErrors         int64          `json:"tls_errors"`
+	StartTime         time.Time      `json:"start_time"`
+	LastActivity      time.Time      `json:"last_activity,omitzero"`
+	Health            string         `json:"health,omitempty"`
+	HealthError       string         `json:"health_error,omitempty"`
+	Balance           string         `json:"balance,omitempty"`
+	Serving           string         `json:"serving,omitempty"`
+	Upstreams         []upstreamInfo `json:"upstreams"`
+	Dynamic           bool           `json:"dynamic"` // added through the admin API
+}
+
+type upstreamInfo struct {
+	Addr              string    `json:"addr"`
+	Health            string    `json:"health,omitempty"`
+	HealthLatencyMS   int64     `json:"health_latency_ms,omitempty"`
+	HealthFailures    int       `json:"health_failures,omitempty"`
+	ActiveConnections int64     `json:"active_connections"`
+	TotalConnections  int64     `json:"total_connections"`
+	DialFailures      int64     `json:"dial_failures"`
+	CertExpiry        time.Time `json:"cert_expiry,omitzero"`
+}
+
+type connInfoJSON struct {
+	ID           uint64    `json:"id"`
+	Proxy        string    `json:"proxy"`
+	Client       string    `json:"client"`
+	Upstream     string    `json:"upstream,omitempty"`
+	Peer         string    `json:"peer,omitempty"`
+	Started      time.Time `json:"started"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// addProxyRequest is the body of POST /proxies. Ports may be given as
+// numbers or strings.
+type addProxyRequest struct {
+	Port        json.Number `json:"port"`
+	TargetPort  json.Number `json:"target_port"`
+	Host        string      `json:"host"`
+	Protocol    string      `json:"protocol"`
+	Description string      `json:"description"`
+}
+
+func (pm *ProxyManager) proxyInfo(key string, stat *ProxyStats) proxyInfo {
+	pm.mu.RLock()
+	_, dynamic := pm.dynamic[key]
+	pm.mu.RUnlock()
+
+	info := proxyInfo{
+		Key:               key,
+		Port:              stat.Port,
+		TargetPort:        stat.TargetPort,
+		Protocol:          stat.Protocol,
+		Host:              stat.Host,
+		Description:       stat.Description,
+		Tags:              stat.Tags,
+		Status:            stat.Status,
+		LocalAddr:         stat.LocalAddr,
+		RemoteAddr:        stat.RemoteAddr,
+		ActiveConnections: stat.ActiveConnections,
+		TotalConnections:  stat.TotalConnections,
+		BytesIn:           stat.BytesIn,
+		BytesOut:          stat.BytesOut,
+		RateIn:            stat.RateIn,
+		RateOut:           stat.RateOut,
+		Datagrams:         stat.Datagrams,
+		Rejected:          stat.Rejected,
+		TLS:               stat.TLS,
+		TLSErrors:         stat.TLSErrors,
+		StartTime:         stat.StartTime,
+		LastActivity:      stat.LastActivity,
+		Health:            stat.HealthStatus,
+		HealthError:       stat.HealthError,
+		Balance:           stat.Balance,
+		Serving:           stat.Serving,
+		Upstreams:         []upstreamInfo{},
+		Dynamic:           dynamic,
+	}
+	for _, us := range stat.Upstreams {
+		info.Upstreams = append(info.Upstreams, upstreamInfo{
+			Addr:              us.Addr,
+			Health:            us.HealthStatus,
+			HealthLatencyMS:   us.HealthLatency.Milliseconds(),
+			HealthFailures:    us.HealthFailures,
+			ActiveConnections: us.ActiveConnections,
+			TotalConnections:  us.TotalConnections,
+			DialFailures:      us.DialFailures,
+			CertExpiry:        us.CertExpiry,
+		})
+	}
+	return info
+}
+
+// defaultAdminSocket is where an instance opens its admin API unless
+// --admin-addr says otherwise, and where `proxy ctl` looks for it.
+func defaultAdminSocket() string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, fmt.Sprintf("proxy-%d.sock", os.Getuid()))
+}
+
+// serveAdmin serves the admin API on addr, which is either a Unix socket path
+// or a loopback host:port. The listener is bound before returning so a bad
+// address fails at startup; the returned func closes it.
+func (pm *ProxyManager) serveAdmin(addr string) (func(), error) {
+	listener, err := listenAdmin(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start admin API on %s: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /proxies", pm.handleListProxies)
+	mux.HandleFunc("POST /proxies", pm.handleAddProxy)
+	mux.HandleFunc("GET /proxies/{port}", pm.handleGetProxy)
+	mux.HandleFunc("DELETE /proxies/{port}", pm.handleRemoveProxy)
+	mux.HandleFunc("POST /proxies/{port}/restart", pm.handleRestartProxy)
+	mux.HandleFunc("POST /proxies/{port}/failback", pm.handleFailback)
+	mux.HandleFunc("GET /connections", pm.handleListConnections)
+	mux.HandleFunc("DELETE /connections/{id}", pm.handleCloseConnection)
+
+	slog.Info("Serving admin API", "addr", addr)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Error("Admin API stopped", "error", err)
+		}
+	}()
+	return func() { listener.Close() }, nil
+}
+
+// listenAdmin binds a Unix socket when addr looks like a path, replacing a
+// stale socket left by a previous run. Anything else at that path is left
+// alone. TCP addresses must be loopback since the API has no authentication.
+func listenAdmin(addr string) (net.Listener, error) {
+	if strings.ContainsRune(addr, os.PathSeparator) || strings.HasSuffix(addr, ".sock") {
+		if err := removeStaleSocket(addr); err != nil {
+			return nil, err
+		}
+
+		listener, err := net.Listen("unix", addr)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(addr, 0o600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("admin API must listen on a loopback address or a Unix socket")
+	}
+	return net.Listen("tcp", addr)
+}
+
+// removeStaleSocket removes the socket at path if nothing is listening on it
+// any more.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("another instance is already listening")
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// proxyKey maps the {port} path segment and an optional ?protocol=udp to the
+// proxy's stats key.
+func proxyKey(r *http.Request) string {
+	key := r.PathValue("port")
+	if strings.EqualFold(r.URL.Query().Get("protocol"), "udp") {
+		key += "/udp"
+	}
+	return key
+}
+
+func (pm *ProxyManager) handleListProxies(w http.ResponseWriter, r *http.Request) {
+	stats := pm.GetStats()
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		pi, _ := strconv.Atoi(stats[keys[i]].Port)
+		pj, _ := strconv.Atoi(stats[keys[j]].Port)
+		if pi != pj {
+			return pi < pj
+		}
+		return keys[i] < keys[j]
+	})
+
+	infos := make([]proxyInfo, 0, len(keys))
+	for _, key := range keys {
+		infos = append(infos, pm.proxyInfo(key, stats[key]))
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (pm *ProxyManager) handleGetProxy(w http.ResponseWriter, r *http.Request) {
+	key := proxyKey(r)
+	stat, ok := pm.GetStats()[key]
+	if !ok {
+		writeError(w, http.StatusNotFound, errNoProxy)
+		return
+	}
+	writeJSON(w, http.StatusOK, pm.proxyInfo(key, stat))
+}
+
+func (pm *ProxyManager) handleAddProxy(w http.ResponseWriter, r *http.Request) {
+	var req addProxyRequest
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return
+	}
+
+	cfg := ProxyConfig{
+		Host:        req.Host,
+		Port:        req.Port.String(),
+		TargetPort:  req.TargetPort.String(),
+		Protocol:    strings.ToLower(req.Protocol),
+		Description: req.Description,
+	}
+	switch err := pm.AddProxy(cfg); {
+	case errors.Is(err, errShuttingDown):
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	key := cfg.Port
+	if cfg.Protocol == "udp" {
+		key += "/udp"
+	}
+	stat, ok := pm.GetStats()[key]
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errNoProxy)
+		return
+	}
+	writeJSON(w, http.StatusCreated, pm.proxyInfo(key, stat))
+}
+
+func (pm *ProxyManager) handleRemoveProxy(w http.ResponseWriter, r *http.Request) {
+	key := proxyKey(r)
+	switch err := pm.RemoveProxy(key); {
+	case errors.Is(err, errShuttingDown):
+		writeError(w, http.StatusServiceUnavailable, err)
+	case errors.Is(err, errSingleProxy):
+		writeError(w, http.StatusConflict, err)
+	case err != nil:
+		writeError(w, http.StatusNotFound, err)
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"removed": key})
+	}
+}
+
+func (pm *ProxyManager) handleRestartProxy(w http.ResponseWriter, r *http.Request) {
+	key := proxyKey(r)
+	switch err := pm.RestartProxy(key); {
+	case errors.Is(err, errNoProxy):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, errShuttingDown):
+		writeError(w, http.StatusServiceUnavailable, err)
+	case err != nil:
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"restarted": key})
+	}
+}
+
+func (pm *ProxyManager) handleFailback(w http.ResponseWriter, r *http.Request) {
+	switch serving, err := pm.Failback(proxyKey(r)); {
+	case errors.Is(err, errNoProxy):
+		writeError(w, http.StatusNotFound, err)
+	case err != nil:
+		writeError(w, http.StatusConflict, err)
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"serving": serving})
+	}
+}
+
+func (pm *ProxyManager) handleListConnections(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("proxy")
+	if key != "" {
+		if _, ok := pm.GetStats()[key]; !ok {
+			writeError(w, http.StatusNotFound, errNoProxy)
+			return
+		}
+	}
+
+	conns := []connInfoJSON{}
+	for _, c := range pm.Connections(key) {
+		conns = append(conns, connInfoJSON{
+			ID:           c.ID,
+			Proxy:        c.Proxy,
+			Client:       c.Client,
+			Upstream:     c.Upstream,
+			Peer:         c.Peer,
+			Started:      c.Started,
+			BytesIn:      c.BytesIn,
+			BytesOut:     c.BytesOut,
+			LastActivity: c.LastActivity,
+		})
+	}
+	writeJSON(w, http.StatusOK, conns)
+}
+
+func (pm *ProxyManager) handleCloseConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid connection id %q", r.PathValue("id")))
+		return
+	}
+	if !pm.CloseConnection(id) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such connection"))
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]uint64{"closed": id})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
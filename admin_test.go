@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// errString is err's message, or "" for nil.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// adminClient serves pm's admin API on a socket in a temporary directory and
+// returns a client that talks to it.
+func adminClient(t *testing.T, pm *ProxyManager) *http.Client {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	stop, err := pm.serveAdmin(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	pm := NewProxyManager()
+	pm.mode = "forward"
+	client := adminClient(t, pm)
+
+	_, port, _ := net.SplitHostPort(closedAddr(t))
+	t.Cleanup(func() { pm.stopProxy(port, true) })
+
+	// Run in order: later steps depend on the proxy added earlier
+	steps := []struct {
+		method, path, body string
+		want               int
+	}{
+		{"GET", "/proxies", "", http.StatusOK},
+		{"GET", "/proxies/" + port, "", http.StatusNotFound},
+		{"POST", "/proxies", `{"port": `, http.StatusBadRequest},
+		{"POST", "/proxies", `{"port": 80, "bogus": true}`, http.StatusBadRequest},
+		{"POST", "/proxies", `{"port": 0}`, http.StatusBadRequest},
+		{"POST", "/proxies", `{"port": ` + port + `, "host": "127.0.0.1", "target_port": 9}`, http.StatusCreated},
+		{"POST", "/proxies", `{"port": "` + port + `", "host": "127.0.0.1"}`, http.StatusBadRequest},
+		{"GET", "/proxies/" + port, "", http.StatusOK},
+		{"GET", "/proxies/" + port + "?protocol=udp", "", http.StatusNotFound},
+		{"POST", "/proxies/" + port + "/restart", "", http.StatusOK},
+		{"POST", "/proxies/1/restart", "", http.StatusNotFound},
+		{"POST", "/proxies/" + port + "/failback", "", http.StatusConflict},
+		{"POST", "/proxies/1/failback", "", http.StatusNotFound},
+		{"GET", "/connections", "", http.StatusOK},
+		{"GET", "/connections?proxy=" + port, "", http.StatusOK},
+		{"GET", "/connections?proxy=1", "", http.StatusNotFound},
+		{"DELETE", "/connections/abc", "", http.StatusBadRequest},
+		{"DELETE", "/connections/99", "", http.StatusNotFound},
+		{"DELETE", "/proxies/" + port, "", http.StatusOK},
+		{"DELETE", "/proxies/" + port, "", http.StatusNotFound},
+		{"PUT", "/proxies", "", http.StatusMethodNotAllowed},
+	}
+
+	for _, step := range steps {
+		req, err := http.NewRequest(step.method, "http://admin"+step.path, strings.NewReader(step.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != step.want {
+			t.Errorf("%s %s %s = %d, want %d", step.method, step.path, step.body, resp.StatusCode, step.want)
+		}
+	}
+}
+
+func TestListenAdmin(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr string
+	}{
+		{addr: "127.0.0.1:0"},
+		{addr: "localhost:0"},
+		{addr: "0.0.0.0:0", wantErr: "admin API must listen on a loopback address or a Unix socket"},
+		{addr: "192.0.2.1:0", wantErr: "admin API must listen on a loopback address or a Unix socket"},
+		{addr: "nowhere", wantErr: "address nowhere: missing port in address"},
+	}
+
+	for _, tt := range tests {
+		ln, err := listenAdmin(tt.addr)
+		if ln != nil {
+			ln.Close()
+		}
+		if got := errString(err); got != tt.wantErr {
+			t.Errorf("listenAdmin(%q) = %q, want %q", tt.addr, got, tt.wantErr)
+		}
+	}
+}
+
+func TestAdminShuttingDown(t *testing.T) {
+	pm := NewProxyManager()
+	pm.mode = "forward"
+	client := adminClient(t, pm)
+	pm.closing = true
+
+	for _, step := range []struct{ method, path, body string }{
+		{"POST", "/proxies", `{"port": 80, "host": "127.0.0.1"}`},
+		{"DELETE", "/proxies/80", ""},
+		{"POST", "/proxies/80/restart", ""},
+	} {
+		req, _ := http.NewRequest(step.method, "http://admin"+step.path, strings.NewReader(step.body))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s %s while shutting down = %d, want %d", step.method, step.path, resp.StatusCode, http.StatusServiceUnavailable)
+		}
+	}
+}
+
+// TestAdminSingleProxy checks that the one proxy given on the command line
+// can't be removed or restarted, since the process lives only as long as it.
+func TestAdminSingleProxy(t *testing.T) {
+	pm := NewProxyManager()
+	pm.mode = "forward"
+	client := adminClient(t, pm)
+
+	_, port, _ := net.SplitHostPort(closedAddr(t))
+	errc := make(chan error, 1)
+	go func() { errc <- pm.RunSingleForwardProxy(net.JoinHostPort("127.0.0.1", "9"), port) }()
+	t.Cleanup(func() { pm.stopProxy(port, false) })
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pm.mu.RLock()
+		rp := pm.running[port]
+		pm.mu.RUnlock()
+		if rp != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the proxy never started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, step := range []struct{ method, path string }{
+		{"DELETE", "/proxies/" + port},
+		{"POST", "/proxies/" + port + "/restart"},
+	} {
+		req, _ := http.NewRequest(step.method, "http://admin"+step.path, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("%s %s = %d, want %d", step.method, step.path, resp.StatusCode, http.StatusConflict)
+		}
+	}
+
+	select {
+	case err := <-errc:
+		t.Fatalf("the proxy stopped: %v", err)
+	default:
+	}
+}
+
+func TestListenAdminSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "file.sock")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenAdmin(file); errString(err) != file+" exists and is not a socket" {
+		t.Errorf("listenAdmin over a file = %v", err)
+	}
+
+	// A socket left behind by an instance that died is replaced
+	stale := filepath.Join(dir, "stale.sock")
+	ln, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ln, err = listenAdmin(stale)
+	if err != nil {
+		t.Fatalf("listenAdmin over a stale socket: %v", err)
+	}
+	defer ln.Close()
+
+	// A live one is not
+	if _, err := listenAdmin(stale); errString(err) != "another instance is already listening" {
+		t.Errorf("listenAdmin over a live socket = %v", err)
+	}
+	if info, err := os.Stat(stale); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestCheckSocketOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkSocketOwner(path); err != nil {
+		t.Errorf("own socket refused: %v", err)
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner needs root")
+	}
+	if err := os.Chown(path, 12345, 12345); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := errString(checkSocketOwner(path)), path+" belongs to another user"; got != want {
+		t.Errorf("someone else's socket = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The shared-key handshake lets a reverse proxy turn away anyone but our own
+// forwarders. Right after accepting, the reverse side sends authMagic and a
+// random nonce. The forward side answers with HMAC-SHA256 of both under the
+// shared key, and the reverse side acknowledges with authOK before relaying.
+const (
+	authMagic     = "PXA1"
+	authNonceSize = 32
+	authOK        = 1
+
+	// authTimeout bounds the handshake when the entry has no dial timeout.
+	authTimeout = 10 * time.Second
+
+	// minAuthKeyLen keeps keys from being guessable.
+	minAuthKeyLen = 16
+)
+
+// closeAuthFailed is the access log reason for clients that failed the
+// shared-key handshake.
+const closeAuthFailed = "auth_failed"
+
+var errAuthRejected = errors.New("shared key rejected by the reverse proxy")
+
+// loadAuthKey reads the shared key from the file, if given, or from
+// PROXY_AUTH_KEY. It returns nil when neither is set.
+func loadAuthKey(path string) ([]byte, error) {
+	key := os.Getenv("PROXY_AUTH_KEY")
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read auth key: %v", err)
+		}
+		key = string(data)
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return nil, nil
+	}
+	if len(key) < minAuthKeyLen {
+		return nil, fmt.Errorf("auth key must be at least %d characters", minAuthKeyLen)
+	}
+	return []byte(key), nil
+}
+
+// usesAuth reports whether connections for cfg go through the handshake one
+// by one. The mux session runs it once for all of its streams.
+func (pm *ProxyManager) usesAuth(cfg ProxyConfig) bool {
+	return pm.authKey != nil && cfg.Protocol == "tcp" && !cfg.NoAuth && !pm.muxes(cfg)
+}
+
+func authMAC(key, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(authMagic))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// verifyClient runs the reverse side of the handshake. It returns io.EOF if
+// the client hung up without sending anything, as TCP health checks do.
+func verifyClient(conn net.Conn, key []byte, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := make([]byte, authNonceSize)
+	rand.Read(nonce)
+	if _, err := conn.Write(append([]byte(authMagic), nonce...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, sha256.Size)
+	if n, err := io.ReadFull(conn, reply); err != nil {
+		if n == 0 && err == io.EOF {
+			return io.EOF
+		}
+		return fmt.Errorf("incomplete handshake: %v", err)
+	}
+	if !hmac.Equal(reply, authMAC(key, nonce)) {
+		return errors.New("wrong shared key")
+	}
+	_, err := conn.Write([]byte{authOK})
+	return err
+}
+
+// authenticate runs the forward side of the handshake on a freshly dialed
+// upstream connection.
+func authenticate(conn net.Conn, key []byte, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	challenge := make([]byte, len(authMagic)+authNonceSize)
+	if _, err := io.ReadFull(conn, challenge); err != nil {
+		return fmt.Errorf("no auth challenge from %s, is it a reverse proxy with a shared key? (%v)", conn.RemoteAddr(), err)
+	}
+	if !bytes.HasPrefix(challenge, []byte(authMagic)) {
+		return fmt.Errorf("no auth challenge from %s, is it a reverse proxy with a shared key?", conn.RemoteAddr())
+	}
+	if _, err := conn.Write(authMAC(key, challenge[len(authMagic):])); err != nil {
+		return err
+	}
+
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ack); err != nil || ack[0] != authOK {
+		return errAuthRejected
+	}
+	return nil
+}
+
+// verifyConn runs the handshake for a client of a reverse proxy. Clients that
+// fail it are counted as rejected; ones that hang up without a word, like TCP
+// health checks, are not.
+func (pm *ProxyManager) verifyConn(rp *runningProxy, conn *proxyConn) bool {
+	timeout := rp.cfg.DialTimeout
+	if timeout == 0 {
+		timeout = authTimeout
+	}
+
+	err := verifyClient(conn.client, pm.authKey, timeout)
+	switch {
+	case err == nil:
+		return true
+	case err == io.EOF:
+		conn.setReason(closeClient, nil)
+	default:
+		key := rp.cfg.Key()
+		conn.setReason(closeAuthFailed, err)
+		pm.UpdateStats(key, "rejected", int64(1))
+		slog.Warn("Rejected client that failed the shared-key handshake", "proxy", key, "client", conn.client.RemoteAddr(), "error", err)
+	}
+	return false
+}
+
+// dialer returns how rp's upstreams are dialed, for clients and health
+// checks alike. It opens a stream when the entry goes through the mux.
+// Otherwise it wraps the connection in TLS if the entry asks for it and, in
+// forward mode with a shared key, performs the handshake.
+func (pm *ProxyManager) dialer(rp *runningProxy) dialFunc {
+	return func(addr string, timeout time.Duration) (net.Conn, error) {
+		if pm.mode == "forward" && pm.muxes(rp.cfg) {
+			return pm.muxClient.dial(addr, timeout)
+		}
+		conn, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		if rp.upstreamTLS != nil {
+			if conn, err = pm.originateTLS(rp, conn, addr, timeout); err != nil {
+				return nil, err
+			}
+		}
+		if pm.mode != "forward" || !pm.usesAuth(rp.cfg) {
+			return conn, nil
+		}
+
+		if timeout == 0 {
+			timeout = authTimeout
+		}
+		if err := authenticate(conn, pm.authKey, timeout); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	testAuthKey  = []byte("0123456789abcdef-shared")
+	wrongAuthKey = []byte("fedcba9876543210-shared")
+)
+
+// pipeHandshake runs server and client on the two ends of a pipe, closing
+// each end once its side returns, and returns what the server and client
+// returned.
+func pipeHandshake(server, client func(net.Conn) error) (serverErr, clientErr error) {
+	serverConn, clientConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer clientConn.Close()
+		done <- client(clientConn)
+	}()
+	serverErr = server(serverConn)
+	serverConn.Close()
+	return serverErr, <-done
+}
+
+func TestVerifyClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		client  func(net.Conn) error
+		wantErr string
+	}{
+		{
+			name:   "good key",
+			client: func(c net.Conn) error { return authenticate(c, testAuthKey, time.Second) },
+		},
+		{
+			name:    "bad key",
+			client:  func(c net.Conn) error { return authenticate(c, wrongAuthKey, time.Second) },
+			wantErr: "wrong shared key",
+		},
+		{
+			name: "hang up after the challenge",
+			client: func(c net.Conn) error {
+				_, err := io.ReadFull(c, make([]byte, len(authMagic)+authNonceSize))
+				return err
+			},
+			wantErr: io.EOF.Error(),
+		},
+		{
+			name: "short reply",
+			client: func(c net.Conn) error {
+				if _, err := io.ReadFull(c, make([]byte, len(authMagic)+authNonceSize)); err != nil {
+					return err
+				}
+				_, err := c.Write([]byte("short"))
+				return err
+			},
+			wantErr: "incomplete handshake: unexpected EOF",
+		},
+		{
+			name: "silent client",
+			client: func(c net.Conn) error {
+				_, err := io.ReadFull(c, make([]byte, len(authMagic)+authNonceSize))
+				time.Sleep(200 * time.Millisecond)
+				return err
+			},
+			wantErr: "incomplete handshake: read pipe: i/o timeout",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverErr, clientErr := pipeHandshake(func(c net.Conn) error {
+				return verifyClient(c, testAuthKey, 50*time.Millisecond)
+			}, tt.client)
+			if got := errString(serverErr); got != tt.wantErr {
+				t.Errorf("verifyClient = %q, want %q", got, tt.wantErr)
+			}
+			if tt.wantErr == "" && clientErr != nil {
+				t.Errorf("client failed: %v", clientErr)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := []struct {
+		name    string
+		server  func(net.Conn) error
+		wantErr string
+	}{
+		{
+			name:   "good key",
+			server: func(c net.Conn) error { return verifyClient(c, testAuthKey, time.Second) },
+		},
+		{
+			name:    "bad key",
+			server:  func(c net.Conn) error { return verifyClient(c, wrongAuthKey, time.Second) },
+			wantErr: errAuthRejected.Error(),
+		},
+		{
+			name:    "server hangs up",
+			server:  func(c net.Conn) error { return nil },
+			wantErr: "no auth challenge from pipe, is it a reverse proxy with a shared key? (EOF)",
+		},
+		{
+			name: "server without a shared key",
+			server: func(c net.Conn) error {
+				_, err := c.Write([]byte("SSH-2.0-OpenSSH_9.6 banner that is longer than the challenge\r\n"))
+				return err
+			},
+			wantErr: "no auth challenge from pipe, is it a reverse proxy with a shared key?",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientErr, serverErr := pipeHandshake(func(c net.Conn) error {
+				return authenticate(c, testAuthKey, time.Second)
+			}, tt.server)
+			if got := errString(clientErr); got != tt.wantErr {
+				t.Errorf("authenticate = %q, want %q", got, tt.wantErr)
+			}
+			if tt.wantErr == "" && serverErr != nil {
+				t.Errorf("server failed: %v", serverErr)
+			}
+		})
+	}
+}
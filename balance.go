@@ -0,0 +1,200 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Upstream is one target of a proxy that balances across several.
+type Upstream struct {
+	Host string
+	Port string
+}
+
+// UpstreamStats is the per-target view of a proxy's traffic and health.
+type UpstreamStats struct {
+	Addr              string
+	ActiveConnections int64
+	TotalConnections  int64
+
+	DialFailures int64
+	DialLatency  Histogram
+
+	HealthStatus    string
+	HealthCheckedAt time.Time
+	HealthLatency   time.Duration
+	HealthFailures  int
+	HealthError     string
+
+	CertExpiry time.Time // when the upstream's TLS certificate expires, if known
+}
+
+// snapshot copies the stats, reading the connection counters atomically like
+// ProxyStats.snapshot. The caller holds pm.mu.
+func (us *UpstreamStats) snapshot() UpstreamStats {
+	return UpstreamStats{
+		Addr:              us.Addr,
+		ActiveConnections: atomic.LoadInt64(&us.ActiveConnections),
+		TotalConnections:  atomic.LoadInt64(&us.TotalConnections),
+		DialFailures:      us.DialFailures,
+		DialLatency:       us.DialLatency,
+		HealthStatus:      us.HealthStatus,
+		HealthCheckedAt:   us.HealthCheckedAt,
+		HealthLatency:     us.HealthLatency,
+		HealthFailures:    us.HealthFailures,
+		HealthError:       us.HealthError,
+		CertExpiry:        us.CertExpiry,
+	}
+}
+
+func validBalance(balance string) bool {
+	switch balance {
+	case "round-robin", "least-connections", "random", "failover":
+		return true
+	}
+	return false
+}
+
+// upstream is a target of a running proxy. Its counters live in the proxy's
+// stats so they show up in the dashboard.
+type upstream struct {
+	addr    string
+	stats   *UpstreamStats
+	healthy atomic.Bool
+	recheck chan struct{} // asks the monitor to check right away
+
+	healthySince time.Time // when the upstream last became healthy, guarded by the proxy's mu
+}
+
+// targetAddrs lists the addresses cfg relays to. Reverse mode always targets
+// this machine, so only the upstream ports are used there.
+func (pm *ProxyManager) targetAddrs(cfg ProxyConfig) []string {
+	if len(cfg.Upstreams) == 0 {
+		_, targetAddr := pm.proxyAddrs(cfg)
+		return []string{targetAddr}
+	}
+
+	addrs := make([]string, len(cfg.Upstreams))
+	for i, u := range cfg.Upstreams {
+		host := u.Host
+		if pm.mode == "reverse" {
+			host = "localhost"
+		}
+		addrs[i] = net.JoinHostPort(host, u.Port)
+	}
+	return addrs
+}
+
+// pickUpstream chooses the target for a new connection using the entry's
+// balance strategy. Upstreams failing their health check are skipped unless
+// none are healthy, in which case every target is tried as a last resort.
+func (rp *runningProxy) pickUpstream() *upstream {
+	if len(rp.upstreams) == 1 {
+		return rp.upstreams[0]
+	}
+	if rp.cfg.Balance == "failover" {
+		rp.mu.Lock()
+		defer rp.mu.Unlock()
+		return rp.upstreams[rp.serving]
+	}
+
+	var candidates []*upstream
+	for _, u := range rp.upstreams {
+		if u.healthy.Load() {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = rp.upstreams
+	}
+
+	switch rp.cfg.Balance {
+	case "least-connections":
+		// Start at the round-robin position so ties are spread out
+		start := int(atomic.AddUint64(&rp.nextUpstream, 1) % uint64(len(candidates)))
+		best := candidates[start]
+		for i := 1; i < len(candidates); i++ {
+			u := candidates[(start+i)%len(candidates)]
+			if atomic.LoadInt64(&u.stats.ActiveConnections) < atomic.LoadInt64(&best.stats.ActiveConnections) {
+				best = u
+			}
+		}
+		return best
+	case "random":
+		return candidates[rand.IntN(len(candidates))]
+	default:
+		n := atomic.AddUint64(&rp.nextUpstream, 1) - 1
+		return candidates[n%uint64(len(candidates))]
+	}
+}
+
+// dialFunc opens a connection to an upstream address.
+type dialFunc func(addr string, timeout time.Duration) (net.Conn, error)
+
+// dialUpstream connects a new client's upstream. Failover proxies fall
+// through to the targets not tried yet when a dial fails: the one the failed
+// dial moved them to, or else the next in order, which matters while health
+// checks haven't marked any standby healthy.
+func (pm *ProxyManager) dialUpstream(rp *runningProxy) (*upstream, net.Conn, error) {
+	dial := pm.dialer(rp)
+	tried := make(map[*upstream]bool)
+	u := rp.pickUpstream()
+	for {
+		tried[u] = true
+		atomic.AddInt64(&u.stats.TotalConnections, 1)
+
+		start := time.Now()
+		conn, err := dial(u.addr, rp.cfg.DialTimeout)
+		pm.recordDial(u.stats, time.Since(start), err)
+		pm.reportDial(rp, u, err)
+		if err == nil {
+			return u, conn, nil
+		}
+		slog.Warn("Failed to connect to upstream", "proxy", rp.cfg.Key(), "upstream", u.addr, "error", err)
+
+		if rp.cfg.Balance != "failover" {
+			return u, nil, err
+		}
+		next := rp.pickUpstream()
+		for _, other := range rp.upstreams {
+			if !tried[next] {
+				break
+			}
+			next = other
+		}
+		if tried[next] {
+			return u, nil, err
+		}
+		u = next
+	}
+}
+
+// nextServing picks the upstream a failover proxy should use. It stays on the
+// current one while it is healthy, except that an earlier upstream that has
+// been healthy for the failback delay takes over again unless failback is
+// manual. When the current one is down, the first healthy upstream in order
+// wins. The caller holds rp.mu.
+func (rp *runningProxy) nextServing() int {
+	current := rp.upstreams[rp.serving]
+	if !current.healthy.Load() {
+		for i, u := range rp.upstreams {
+			if u.healthy.Load() {
+				return i
+			}
+		}
+		return rp.serving
+	}
+
+	if rp.cfg.Failback == "manual" {
+		return rp.serving
+	}
+	for i, u := range rp.upstreams[:rp.serving] {
+		if u.healthy.Load() && time.Since(u.healthySince) >= rp.cfg.FailbackDelay {
+			return i
+		}
+	}
+	return rp.serving
+}
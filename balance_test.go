@@ -0,0 +1,288 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newTestProxy registers cfg with pm as if it were running with one
+// upstream per address, without binding anything.
+func newTestProxy(pm *ProxyManager, cfg ProxyConfig, addrs ...string) *runningProxy {
+	stats := &ProxyStats{Port: cfg.Port}
+	for _, addr := range addrs {
+		stats.Upstreams = append(stats.Upstreams, UpstreamStats{Addr: addr})
+	}
+	pm.mu.Lock()
+	pm.stats[cfg.Key()] = stats
+	pm.mu.Unlock()
+	return newRunningProxy(cfg, stats)
+}
+
+// picks returns the addresses of the next n upstreams rp chooses.
+func picks(rp *runningProxy, n int) []string {
+	var addrs []string
+	for i := 0; i < n; i++ {
+		addrs = append(addrs, rp.pickUpstream().addr)
+	}
+	return addrs
+}
+
+func TestPickUpstream(t *testing.T) {
+	tests := []struct {
+		name    string
+		balance string
+		healthy []bool // per upstream a, b, c
+		active  []int64
+		want    []string
+	}{
+		{
+			name:    "round-robin",
+			balance: "round-robin",
+			healthy: []bool{true, true, true},
+			want:    []string{"a", "b", "c", "a", "b", "c"},
+		},
+		{
+			name:    "round-robin skips unhealthy",
+			balance: "round-robin",
+			healthy: []bool{true, false, true},
+			want:    []string{"a", "c", "a", "c"},
+		},
+		{
+			name:    "every upstream down tries them all",
+			balance: "round-robin",
+			healthy: []bool{false, false, false},
+			want:    []string{"a", "b", "c"},
+		},
+		{
+			name:    "least-connections",
+			balance: "least-connections",
+			healthy: []bool{true, true, true},
+			active:  []int64{3, 1, 2},
+			want:    []string{"b", "b", "b"},
+		},
+		{
+			name:    "least-connections skips unhealthy",
+			balance: "least-connections",
+			healthy: []bool{true, false, true},
+			active:  []int64{3, 1, 2},
+			want:    []string{"c", "c"},
+		},
+		{
+			name:    "least-connections spreads ties",
+			balance: "least-connections",
+			healthy: []bool{true, true, true},
+			active:  []int64{1, 1, 1},
+			want:    []string{"b", "c", "a"},
+		},
+		{
+			name:    "random only picks healthy",
+			balance: "random",
+			healthy: []bool{false, true, false},
+			want:    []string{"b", "b", "b", "b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rp := newTestProxy(NewProxyManager(), ProxyConfig{Port: "80", Balance: tt.balance}, "a", "b", "c")
+			for i, u := range rp.upstreams {
+				u.healthy.Store(tt.healthy[i])
+				if tt.active != nil {
+					u.stats.ActiveConnections = tt.active[i]
+				}
+			}
+			if got := picks(rp, len(tt.want)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("picked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickSingleUpstream(t *testing.T) {
+	rp := newTestProxy(NewProxyManager(), ProxyConfig{Port: "80"}, "a")
+	if got := picks(rp, 2); !reflect.DeepEqual(got, []string{"a", "a"}) {
+		t.Errorf("picked %v, want the only upstream even while it is down", got)
+	}
+}
+
+func TestTargetAddrs(t *testing.T) {
+	cfg := ProxyConfig{
+		Host: "db", Port: "5432", TargetPort: "5432",
+		Upstreams: []Upstream{{Host: "db", Port: "5432"}, {Host: "replica", Port: "6432"}},
+	}
+	tests := []struct {
+		mode string
+		cfg  ProxyConfig
+		want []string
+	}{
+		{mode: "forward", cfg: ProxyConfig{Host: "db", Port: "5432", TargetPort: "6432"}, want: []string{"db:6432"}},
+		{mode: "forward", cfg: cfg, want: []string{"db:5432", "replica:6432"}},
+		{mode: "reverse", cfg: cfg, want: []string{"localhost:5432", "localhost:6432"}},
+	}
+
+	for _, tt := range tests {
+		pm := NewProxyManager()
+		pm.mode = tt.mode
+		if got := pm.targetAddrs(tt.cfg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: targetAddrs = %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestFailoverOrder(t *testing.T) {
+	type step struct {
+		upstream int // index into a, b, c
+		up       bool
+		want     string // upstream serving afterwards
+	}
+	bringUp := []step{{0, true, "a"}, {1, true, "a"}, {2, true, "a"}}
+
+	tests := []struct {
+		name          string
+		failback      string
+		failbackDelay time.Duration
+		steps         []step
+	}{
+		{
+			name: "next healthy in order, then back",
+			steps: append(bringUp,
+				step{0, false, "b"},
+				step{1, false, "c"},
+				step{1, true, "b"},
+				step{0, true, "a"},
+			),
+		},
+		{
+			name: "skips upstreams that are down",
+			steps: append(bringUp,
+				step{1, false, "a"},
+				step{0, false, "c"},
+			),
+		},
+		{
+			name: "stays put when nothing is healthy",
+			steps: append(bringUp,
+				step{0, false, "b"},
+				step{1, false, "c"},
+				step{2, false, "c"},
+			),
+		},
+		{
+			name:     "manual failback",
+			failback: "manual",
+			steps: append(bringUp,
+				step{0, false, "b"},
+				step{0, true, "b"},
+			),
+		},
+		{
+			name:          "failback waits out the delay",
+			failbackDelay: time.Hour,
+			steps: append(bringUp,
+				step{0, false, "b"},
+				step{0, true, "b"},
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm := NewProxyManager()
+			cfg := ProxyConfig{Port: "80", Balance: "failover", Failback: tt.failback, FailbackDelay: tt.failbackDelay}
+			rp := newTestProxy(pm, cfg, "a", "b", "c")
+			for i, s := range tt.steps {
+				var err error
+				if !s.up {
+					err = net.ErrClosed
+				}
+				pm.reportUpstream(rp, rp.upstreams[s.upstream], err)
+				if got := rp.pickUpstream().addr; got != s.want {
+					t.Fatalf("step %d: serving %s, want %s", i, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFailoverDial(t *testing.T) {
+	live, _ := startBanner(t, "")
+	down1, down2 := closedAddr(t), closedAddr(t)
+
+	tests := []struct {
+		name    string
+		checked bool // health checks have passed for every upstream
+	}{
+		{name: "standbys marked healthy", checked: true},
+		{name: "before any health check"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm := NewProxyManager()
+			rp := newTestProxy(pm, ProxyConfig{Port: "80", Balance: "failover"}, down1, down2, live)
+			if tt.checked {
+				for _, u := range rp.upstreams {
+					pm.reportUpstream(rp, u, nil)
+				}
+			}
+
+			u, conn, err := pm.dialUpstream(rp)
+			if err != nil {
+				t.Fatalf("dialUpstream: %v", err)
+			}
+			conn.Close()
+			if u.addr != live {
+				t.Errorf("connected to %s, want the last standby %s", u.addr, live)
+			}
+			if got := pm.GetStats()["80"].Serving; tt.checked && got != live {
+				t.Errorf("stats serving %q, want %q", got, live)
+			}
+		})
+	}
+}
+
+func TestFailback(t *testing.T) {
+	pm := NewProxyManager()
+	cfg := ProxyConfig{Port: "80", Balance: "failover", Failback: "manual"}
+	rp := newTestProxy(pm, cfg, "a", "b", "c")
+	pm.running["80"] = rp
+
+	fail := func(i int, up bool) {
+		var err error
+		if !up {
+			err = net.ErrClosed
+		}
+		pm.reportUpstream(rp, rp.upstreams[i], err)
+	}
+	fail(0, false)
+	fail(1, false)
+	fail(2, true)
+
+	if _, err := pm.Failback("80"); errString(err) != "no upstream before c is healthy" {
+		t.Errorf("Failback with every earlier upstream down = %v", err)
+	}
+
+	fail(1, true)
+	if to, err := pm.Failback("80"); err != nil || to != "b" {
+		t.Errorf("Failback = %q, %v, want b", to, err)
+	}
+	fail(0, true)
+	if to, err := pm.Failback("80"); err != nil || to != "a" {
+		t.Errorf("Failback = %q, %v, want a", to, err)
+	}
+	if _, err := pm.Failback("80"); errString(err) != "port 80 is already served by its primary" {
+		t.Errorf("Failback on the primary = %v", err)
+	}
+	if got := pm.GetStats()["80"].Serving; got != "a" {
+		t.Errorf("stats serving %q, want a", got)
+	}
+
+	pm.running["81"] = newTestProxy(pm, ProxyConfig{Port: "81"}, "a", "b")
+	if _, err := pm.Failback("81"); errString(err) != "port 81 doesn't use failover balancing" {
+		t.Errorf("Failback without failover = %v", err)
+	}
+	if _, err := pm.Failback("82"); err != errNoProxy {
+		t.Errorf("Failback on a missing proxy = %v, want %v", err, errNoProxy)
+	}
+}
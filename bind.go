@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// bindRetryInterval is how often an interface or CIDR bind is resolved again,
+// both while waiting for it to get an address and to notice the address
+// changing.
+const bindRetryInterval = 5 * time.Second
+
+// validBind checks a bind setting: an IP address, localhost, a CIDR matched
+// against the local addresses, or an interface name. Interfaces aren't
+// required to exist yet, since a VPN may bring them up later.
+func validBind(bind string) error {
+	if isAddrBind(bind) {
+		return nil
+	}
+	if strings.Contains(bind, "/") {
+		if _, err := netip.ParsePrefix(bind); err != nil {
+			return fmt.Errorf("bind must be an IP address, interface name or CIDR, got %q", bind)
+		}
+		return nil
+	}
+	if strings.ContainsAny(bind, ": \t") {
+		return fmt.Errorf("bind must be an IP address, interface name or CIDR, got %q", bind)
+	}
+	return nil
+}
+
+// isAddrBind reports whether bind can be listened on as is.
+func isAddrBind(bind string) bool {
+	return bind == "" || bind == "localhost" || net.ParseIP(bind) != nil
+}
+
+// resolveBind turns an interface name or CIDR into one of this machine's
+// addresses, preferring IPv4. Addresses are returned unchanged.
+func resolveBind(bind string) (string, error) {
+	if isAddrBind(bind) {
+		return bind, nil
+	}
+
+	var addrs []net.Addr
+	var err error
+	if prefix, perr := netip.ParsePrefix(bind); perr == nil {
+		if addrs, err = net.InterfaceAddrs(); err != nil {
+			return "", err
+		}
+		addrs = filterAddrs(addrs, prefix.Masked().Contains)
+		if len(addrs) == 0 {
+			return "", fmt.Errorf("no local address in %s", bind)
+		}
+	} else {
+		iface, err := net.InterfaceByName(bind)
+		if err != nil {
+			return "", fmt.Errorf("no interface %s", bind)
+		}
+		if iface.Flags&net.FlagUp == 0 {
+			return "", fmt.Errorf("interface %s is down", bind)
+		}
+		if addrs, err = iface.Addrs(); err != nil {
+			return "", err
+		}
+		// Link-local IPv6 addresses need a zone to listen on
+		addrs = filterAddrs(addrs, func(ip netip.Addr) bool { return !ip.IsLinkLocalUnicast() })
+		if len(addrs) == 0 {
+			return "", fmt.Errorf("interface %s has no address", bind)
+		}
+	}
+
+	for _, addr := range addrs {
+		if ip := addr.(*net.IPNet).IP; ip.To4() != nil {
+			return ip.String(), nil
+		}
+	}
+	return addrs[0].(*net.IPNet).IP.String(), nil
+}
+
+// filterAddrs keeps the interface addresses whose IP passes keep.
+func filterAddrs(addrs []net.Addr, keep func(netip.Addr) bool) []net.Addr {
+	var kept []net.Addr
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if ok && keep(ip.Unmap()) {
+			kept = append(kept, addr)
+		}
+	}
+	return kept
+}
+
+// waitForBind resolves an interface or CIDR bind, retrying until it has an
+// address. It returns false if the proxy is stopped first.
+func (pm *ProxyManager) waitForBind(rp *runningProxy, bind string) (string, bool) {
+	key := rp.cfg.Key()
+	waiting := false
+	for {
+		addr, err := resolveBind(bind)
+		if err == nil {
+			if waiting {
+				pm.addEvent(false, "Port %s is listening on %s (%s)", key, addr, bind)
+			}
+			return addr, true
+		}
+		if !waiting {
+			waiting = true
+			pm.UpdateStats(key, "status", "Waiting")
+			slog.Warn("Waiting for bind address", "proxy", key, "bind", bind, "error", err)
+		}
+
+		select {
+		case <-rp.stopCh:
+			return "", false
+		case <-time.After(bindRetryInterval):
+		}
+	}
+}
+
+// watchBind restarts the proxy when the address its bind resolves to
+// changes or goes away, so it follows a VPN that reconnects.
+func (pm *ProxyManager) watchBind(rp *runningProxy, bind, addr string) {
+	ticker := time.NewTicker(bindRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rp.stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		current, err := resolveBind(bind)
+		if err == nil && current == addr {
+			continue
+		}
+		if err != nil {
+			slog.Warn("Bind address went away, waiting for it to come back", "proxy", rp.cfg.Key(), "bind", bind, "error", err)
+		} else {
+			slog.Info("Bind address changed", "proxy", rp.cfg.Key(), "bind", bind, "from", addr, "to", current)
+		}
+		pm.rebind(rp)
+		return
+	}
+}
+
+// rebind restarts rp so its bind is resolved again, unless it has already
+// been stopped or replaced.
+func (pm *ProxyManager) rebind(rp *runningProxy) {
+	pm.changes.Lock()
+	defer pm.changes.Unlock()
+
+	key := rp.cfg.Key()
+	pm.mu.RLock()
+	current := pm.running[key]
+	pm.mu.RUnlock()
+	if pm.closing || current != rp {
+		return
+	}
+
+	pm.stopProxy(key, false)
+	pm.startProxy(rp.cfg)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	certDir    string
+	certCAName string
+	certDays   int
+	certHosts  []string
+)
+
+var certCmd = &cobra.Command{
+	Use:   "cert",
+	Short: "Issue certificates for the mutual TLS tunnel",
+	Long: `Manage a small team CA and the per-machine certificates forward and reverse
+instances present to each other with --tunnel-ca, --tunnel-cert and
+--tunnel-key. Run "cert init" once, keep ca-key.pem to yourself, and hand each
+machine ca.pem plus its own certificate and key.`,
+}
+
+var certInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Create the team CA",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dir, err := teamCertDir()
+		if err != nil {
+			return err
+		}
+		certPath := filepath.Join(dir, "ca.pem")
+		if _, err := os.Stat(certPath); err == nil {
+			return fmt.Errorf("%s already exists; remove it to start over, which invalidates every issued certificate", certPath)
+		}
+		if err := createCA(certPath, filepath.Join(dir, "ca-key.pem"), certCAName, nil); err != nil {
+			return fmt.Errorf("failed to create team CA: %v", err)
+		}
+
+		fmt.Printf("Created team CA %s\n", certPath)
+		fmt.Printf("Issue a certificate per machine with: proxy cert issue <name>\n")
+		return nil
+	},
+}
+
+var certIssueCmd = &cobra.Command{
+	Use:   "issue <name>",
+	Short: "Issue a certificate for one machine",
+	Long: `Issue a certificate signed by the team CA. The name, usually the machine's
+hostname, is what the other side of the tunnel shows for its connections.`,
+	Example: `  proxy cert issue gpu-box
+  proxy cert issue laptop --days 90`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name := args[0]
+		if name == "" || filepath.Base(name) != name {
+			return fmt.Errorf("invalid name %q: it is also used as the file name", name)
+		}
+		if certDays <= 0 {
+			return errors.New("--days must be positive")
+		}
+		dir, err := teamCertDir()
+		if err != nil {
+			return err
+		}
+		caCertPath := filepath.Join(dir, "ca.pem")
+		caCert, caKey, err := loadCA(caCertPath, filepath.Join(dir, "ca-key.pem"))
+		if err != nil {
+			return fmt.Errorf("%v (run proxy cert init first)", err)
+		}
+
+		template := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: name},
+			NotBefore:   time.Now().Add(-time.Hour),
+			NotAfter:    time.Now().AddDate(0, 0, certDays),
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		}
+		for _, host := range append([]string{name}, certHosts...) {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+		cert, err := signCert(template, caCert, caKey)
+		if err != nil {
+			return fmt.Errorf("failed to issue certificate: %v", err)
+		}
+
+		certPath := filepath.Join(dir, name+".pem")
+		keyPath := filepath.Join(dir, name+"-key.pem")
+		if err := writeKeyPair(certPath, keyPath, cert.Certificate[0], cert.PrivateKey.(*ecdsa.PrivateKey)); err != nil {
+			return fmt.Errorf("failed to write certificate: %v", err)
+		}
+
+		fmt.Printf("Issued %s for %s, valid until %s\n", certPath, name, cert.Leaf.NotAfter.Format(time.DateOnly))
+		fmt.Printf("On %s, run proxy with:\n  --tunnel-ca %s --tunnel-cert %s --tunnel-key %s\n", name, caCertPath, certPath, keyPath)
+		return nil
+	},
+}
+
+func init() {
+	certCmd.PersistentFlags().StringVar(&certDir, "dir", "", "Directory holding the team CA and issued certificates (default <user config dir>/proxy/team)")
+	certInitCmd.Flags().StringVar(&certCAName, "name", "proxy team CA", "Common name of the CA")
+	certIssueCmd.Flags().IntVar(&certDays, "days", 365, "How many days the certificate is valid")
+	certIssueCmd.Flags().StringSliceVar(&certHosts, "host", nil, "Extra hostname or IP address to include (repeatable)")
+
+	for _, cmd := range []*cobra.Command{certInitCmd, certIssueCmd} {
+		cmd.SilenceUsage = true
+		cmd.SilenceErrors = true
+		certCmd.AddCommand(cmd)
+	}
+}
+
+// teamCertDir is --dir, or the team directory under the user config dir.
+func teamCertDir() (string, error) {
+	if certDir != "" {
+		return certDir, nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "team"), nil
+}
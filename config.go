@@ -0,0 +1,937 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// configVersion is the newest structured config schema this build understands.
+const configVersion = 1
+
+// configFileNames are tried in order in each directory while walking up from
+// the working directory. Structured formats win over the legacy line format.
+var configFileNames = []string{".proxy.yaml", ".proxy.yml", ".proxy.toml", ".proxy.conf"}
+
+// Config is a fully validated config file, whatever format it was written in.
+type Config struct {
+	Path    string
+	Mode    string // "forward", "reverse" or empty to leave it to the command line
+	Proxies []ProxyConfig
+}
+
+// ConfigError points at the place in a config file that failed validation.
+type ConfigError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s: %s", e.File, e.Msg)
+}
+
+// fileConfig is the on-disk schema shared by .proxy.yaml and .proxy.toml.
+type fileConfig struct {
+	Version     int               `yaml:"version" toml:"version"`
+	Mode        string            `yaml:"mode" toml:"mode"`
+	DefaultHost string            `yaml:"default_host" toml:"default_host"`
+	Hosts       map[string]string `yaml:"hosts" toml:"hosts"`
+	Bind        string            `yaml:"bind" toml:"bind"`
+	Timeouts    fileTimeouts      `yaml:"timeouts" toml:"timeouts"`
+	Limits      fileLimits        `yaml:"limits" toml:"limits"`
+	Health      *fileHealth       `yaml:"health" toml:"health"`
+	Access      fileAccess        `yaml:"access" toml:"access"`
+	Proxies     []fileProxy       `yaml:"proxies" toml:"proxies"`
+}
+
+type fileTimeouts struct {
+	Dial string `yaml:"dial" toml:"dial"`
+	Idle string `yaml:"idle" toml:"idle"`
+}
+
+type fileLimits struct {
+	MaxConnections int `yaml:"max_connections" toml:"max_connections"`
+}
+
+// fileAccess lists the CIDRs or IP addresses clients may connect from.
+type fileAccess struct {
+	Allow []string `yaml:"allow" toml:"allow"`
+	Deny  []string `yaml:"deny" toml:"deny"`
+}
+
+// fileTLS terminates TLS on an entry's listener. Without cert and key a
+// certificate is issued by the local CA for hosts and this machine.
+type fileTLS struct {
+	Cert  string   `yaml:"cert" toml:"cert"`
+	Key   string   `yaml:"key" toml:"key"`
+	Hosts []string `yaml:"hosts" toml:"hosts"`
+}
+
+// fileUpstreamTLS dials an entry's upstreams over TLS.
+type fileUpstreamTLS struct {
+	ServerName         string `yaml:"server_name" toml:"server_name"`
+	CA                 string `yaml:"ca" toml:"ca"`
+	Cert               string `yaml:"cert" toml:"cert"`
+	Key                string `yaml:"key" toml:"key"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" toml:"insecure_skip_verify"`
+}
+
+type fileHealth struct {
+	Type         string `yaml:"type" toml:"type"`
+	Interval     string `yaml:"interval" toml:"interval"`
+	Timeout      string `yaml:"timeout" toml:"timeout"`
+	Path         string `yaml:"path" toml:"path"`
+	ExpectStatus int    `yaml:"expect_status" toml:"expect_status"`
+	Send         string `yaml:"send" toml:"send"`
+	Expect       string `yaml:"expect" toml:"expect"`
+}
+
+// healthCheck validates the block and converts it to a HealthCheck.
+func (h *fileHealth) healthCheck() (HealthCheck, error) {
+	check := HealthCheck{
+		Type:         strings.ToLower(h.Type),
+		Path:         h.Path,
+		ExpectStatus: h.ExpectStatus,
+		Send:         h.Send,
+		Expect:       h.Expect,
+	}
+	if check.Type == "" {
+		check.Type = "tcp"
+	}
+
+	var err error
+	if check.Interval, err = parseConfigDuration(h.Interval); err != nil {
+		return check, fmt.Errorf("health.interval: %v", err)
+	}
+	if check.Timeout, err = parseConfigDuration(h.Timeout); err != nil {
+		return check, fmt.Errorf("health.timeout: %v", err)
+	}
+
+	switch check.Type {
+	case "tcp":
+	case "http":
+		if check.Path == "" {
+			check.Path = "/"
+		}
+		if !strings.HasPrefix(check.Path, "/") {
+			return check, fmt.Errorf("health.path must start with /, got %q", check.Path)
+		}
+		if check.ExpectStatus != 0 && (check.ExpectStatus < 100 || check.ExpectStatus > 599) {
+			return check, fmt.Errorf("health.expect_status must be an HTTP status code, got %d", check.ExpectStatus)
+		}
+	case "expect":
+		if check.Send == "" && check.Expect == "" {
+			return check, fmt.Errorf("health type expect needs send and/or expect")
+		}
+	default:
+		return check, fmt.Errorf("health.type must be tcp, http or expect, got %q", h.Type)
+	}
+
+	if check.Type != "http" && (check.Path != "" || check.ExpectStatus != 0) {
+		return check, fmt.Errorf("health.path and health.expect_status only apply to http checks")
+	}
+	if check.Type != "expect" && (check.Send != "" || check.Expect != "") {
+		return check, fmt.Errorf("health.send and health.expect only apply to expect checks")
+	}
+	return check, nil
+}
+
+type fileProxy struct {
+	Port          int              `yaml:"port" toml:"port"`
+	TargetPort    int              `yaml:"target_port" toml:"target_port"`
+	Protocol      string           `yaml:"protocol" toml:"protocol"`
+	Host          string           `yaml:"host" toml:"host"`
+	Upstreams     []string         `yaml:"upstreams" toml:"upstreams"`
+	Balance       string           `yaml:"balance" toml:"balance"`
+	Failback      string           `yaml:"failback" toml:"failback"`
+	FailbackDelay string           `yaml:"failback_delay" toml:"failback_delay"`
+	Description   string           `yaml:"description" toml:"description"`
+	Bind          string           `yaml:"bind" toml:"bind"`
+	Tags          []string         `yaml:"tags" toml:"tags"`
+	Timeouts      fileTimeouts     `yaml:"timeouts" toml:"timeouts"`
+	Limits        fileLimits       `yaml:"limits" toml:"limits"`
+	Health        *fileHealth      `yaml:"health" toml:"health"`
+	Access        fileAccess       `yaml:"access" toml:"access"`
+	Auth          *bool            `yaml:"auth" toml:"auth"`
+	TLS           *fileTLS         `yaml:"tls" toml:"tls"`
+	UpstreamTLS   *fileUpstreamTLS `yaml:"upstream_tls" toml:"upstream_tls"`
+	Tunnel        *bool            `yaml:"tunnel" toml:"tunnel"`
+	Mux           *bool            `yaml:"mux" toml:"mux"`
+}
+
+// configRelative resolves a path given in the config file against the
+// file's directory.
+func configRelative(configPath, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configPath), path)
+}
+
+func findConfigFile() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+
+	for {
+		for _, name := range configFileNames {
+			configPath := filepath.Join(dir, name)
+			if _, err := os.Stat(configPath); err == nil {
+				return configPath
+			}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	return ""
+}
+
+// loadProjectConfig finds the nearest config file and loads it.
+func loadProjectConfig() (*Config, error) {
+	configFile := findConfigFile()
+	if configFile == "" {
+		return nil, fmt.Errorf("no .proxy.yaml, .proxy.toml or .proxy.conf file found")
+	}
+	return loadConfig(configFile)
+}
+
+// loadConfig reads a config file in the format implied by its extension.
+func loadConfig(path string) (*Config, error) {
+	var configs []ProxyConfig
+	var mode string
+	var err error
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml", ".toml":
+		mode, configs, err = parseStructuredConfig(path)
+	default:
+		configs, err = parseConfigFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(configs) == 0 {
+		return nil, &ConfigError{File: path, Msg: "no proxies configured"}
+	}
+
+	return &Config{Path: path, Mode: mode, Proxies: configs}, nil
+}
+
+func parseConfigFile(filename string) ([]ProxyConfig, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var configs []ProxyConfig
+	var errs []error
+	var sectionHost string
+	seen := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		invalid := func(format string, args ...interface{}) {
+			errs = append(errs, &ConfigError{File: filename, Line: lineNo, Msg: fmt.Sprintf(format, args...)})
+		}
+
+		// [host name] applies to every following entry without its own host
+		if strings.HasPrefix(line, "[host ") && strings.HasSuffix(line, "]") {
+			sectionHost = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(line, "[host "), "]"))
+			continue
+		}
+
+		host, entry := splitEntryHost(line)
+		if host == "" {
+			host = sectionHost
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		config := ProxyConfig{
+			Host:     host,
+			Port:     parts[0],
+			Protocol: "tcp",
+		}
+
+		if len(parts) > 1 {
+			config.Description = parts[1]
+		}
+
+		// An optional /tcp or /udp suffix selects the protocol, e.g. 53/udp
+		if port, proto, ok := strings.Cut(config.Port, "/"); ok {
+			config.Port = port
+			config.Protocol = strings.ToLower(proto)
+		}
+
+		// listen->target maps a different port on the other side, e.g. 13000->3000
+		config.TargetPort = config.Port
+		if listen, target, ok := strings.Cut(config.Port, "->"); ok {
+			config.Port = strings.TrimSpace(listen)
+			config.TargetPort = strings.TrimSpace(target)
+		}
+
+		if !validPort(config.Port) {
+			if key := structuredKey(line); key != "" {
+				invalid("%s is only supported in .proxy.yaml and .proxy.toml", key)
+			} else {
+				invalid("invalid port %q", config.Port)
+			}
+			continue
+		}
+
+		if !validPort(config.TargetPort) {
+			invalid("invalid target port %q", config.TargetPort)
+			continue
+		}
+
+		if config.Protocol != "tcp" && config.Protocol != "udp" {
+			invalid("unsupported protocol %q", config.Protocol)
+			continue
+		}
+
+		if first, dup := seen[config.Key()]; dup {
+			invalid("port %s is already configured on line %d", config.Key(), first)
+			continue
+		}
+		seen[config.Key()] = lineNo
+
+		configs = append(configs, config)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return configs, errors.Join(errs...)
+}
+
+// structuredKeys are entry settings that .proxy.conf has no syntax for, so
+// a line trying to set one gets pointed at the structured formats.
+var structuredKeys = []string{"access", "allow", "deny", "auth"}
+
+// structuredKey returns the setting a .proxy.conf line starts with, like auth
+// in "auth: false", if it is one of structuredKeys.
+func structuredKey(line string) string {
+	key := line
+	if i := strings.IndexAny(line, ":= \t"); i != -1 {
+		key = line[:i]
+	}
+	key = strings.ToLower(key)
+	if slices.Contains(structuredKeys, key) {
+		return key
+	}
+	return ""
+}
+
+// splitEntryHost separates an optional leading host from a config entry, so
+// both "5432:Postgres" and "db-box:5432:Postgres" are accepted. IPv6 hosts
+// must be bracketed, as in "[fd7a::1]:5432:Postgres".
+func splitEntryHost(line string) (host, entry string) {
+	if strings.HasPrefix(line, "[") {
+		if end := strings.Index(line, "]:"); end != -1 {
+			return line[1:end], line[end+2:]
+		}
+	}
+
+	first, rest, ok := strings.Cut(line, ":")
+	if !ok {
+		return "", line
+	}
+
+	// The port spec always starts with a number, hosts never parse as one
+	port, _, _ := strings.Cut(first, "/")
+	port, _, _ = strings.Cut(port, "->")
+	if _, err := strconv.Atoi(strings.TrimSpace(port)); err == nil {
+		return "", line
+	}
+	return first, rest
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+// parseStructuredConfig decodes a YAML or TOML config, rejecting unknown keys,
+// and validates it against the schema.
+func parseStructuredConfig(path string) (string, []ProxyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var fc fileConfig
+	var lines configLines
+	if filepath.Ext(path) == ".toml" {
+		err = decodeTOML(path, data, &fc)
+		lines = tomlLines(data)
+	} else {
+		err = decodeYAML(path, data, &fc)
+		lines = yamlLines(data)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	configs, err := fc.validate(path, lines)
+	return fc.Mode, configs, err
+}
+
+// configLines records where top-level keys and proxy entries start, so
+// validation errors can point at the offending part of the file.
+type configLines struct {
+	keys    map[string]int
+	proxies []int
+}
+
+func decodeYAML(path string, data []byte, fc *fileConfig) error {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(fc); err != nil {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			// yaml.v3 already prefixes each of these with "line N:"
+			lines := yamlLines(data)
+			var errs []error
+			for _, msg := range typeErr.Errors {
+				line := yamlErrorLine(msg)
+				errs = append(errs, &ConfigError{File: path, Line: line, Msg: yamlErrorMsg(msg, line, lines)})
+			}
+			return errors.Join(errs...)
+		}
+		return &ConfigError{File: path, Line: yamlErrorLine(err.Error()), Msg: yamlErrorMsg(err.Error(), 0, configLines{})}
+	}
+	return nil
+}
+
+var yamlLinePattern = regexp.MustCompile(`line (\d+): `)
+
+func yamlErrorLine(msg string) int {
+	if m := yamlLinePattern.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return line
+	}
+	return 0
+}
+
+var (
+	yamlUnknownPattern = regexp.MustCompile(`^field (\S+) not found in type main\.(\w+)$`)
+	yamlTypePattern    = regexp.MustCompile(`into (\[\])?(main\.\w+|map\[string\]string)`)
+)
+
+// yamlSections maps the decoded types to where they appear in the file. The
+// blocks that can be global or per entry are told apart by their line.
+var yamlSections = map[string]string{
+	"fileProxy":       "proxies",
+	"fileTLS":         "proxies.tls",
+	"fileUpstreamTLS": "proxies.upstream_tls",
+	"fileTimeouts":    "timeouts",
+	"fileLimits":      "limits",
+	"fileHealth":      "health",
+	"fileAccess":      "access",
+}
+
+// yamlErrorMsg strips yaml.v3's prefixes and words messages that name Go
+// types the way validation errors are worded.
+func yamlErrorMsg(msg string, line int, lines configLines) string {
+	msg = strings.TrimPrefix(msg, "yaml: ")
+	if loc := yamlLinePattern.FindStringIndex(msg); loc != nil && loc[0] == 0 {
+		msg = msg[loc[1]:]
+	}
+
+	if m := yamlUnknownPattern.FindStringSubmatch(msg); m != nil {
+		var section []string
+		if name, ok := yamlSections[m[2]]; ok {
+			section = strings.Split(name, ".")
+			if section[0] != "proxies" && lines.inProxies(line) {
+				section = append([]string{"proxies"}, section...)
+			}
+		}
+		return unknownKey(section, m[1], line, lines)
+	}
+	return yamlTypePattern.ReplaceAllStringFunc(msg, func(into string) string {
+		if strings.HasPrefix(into, "into []") {
+			return "into a list"
+		}
+		return "into a mapping"
+	})
+}
+
+// unknownKey words an unknown key in section, a path such as
+// ["proxies", "health"], with the index of the entry the line falls in.
+func unknownKey(section []string, key string, line int, lines configLines) string {
+	if len(section) == 0 {
+		return fmt.Sprintf("unknown key %q", key)
+	}
+	path := append([]string(nil), section...)
+	if path[0] == "proxies" {
+		path[0] = fmt.Sprintf("proxies[%d]", lines.proxyAt(line))
+	}
+	return fmt.Sprintf("%s: unknown key %q", strings.Join(path, "."), key)
+}
+
+// proxyAt returns the index of the proxy entry that line falls in.
+func (l configLines) proxyAt(line int) int {
+	index := 0
+	for i, start := range l.proxies {
+		if start <= line {
+			index = i
+		}
+	}
+	return index
+}
+
+// inProxies reports whether line falls in the proxies list rather than a
+// later top-level key.
+func (l configLines) inProxies(line int) bool {
+	start, ok := l.keys["proxies"]
+	if !ok || line <= start {
+		return false
+	}
+	for _, keyLine := range l.keys {
+		if keyLine > start && keyLine <= line {
+			return false
+		}
+	}
+	return true
+}
+
+func yamlLines(data []byte) configLines {
+	lines := configLines{keys: make(map[string]int)}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil || len(root.Content) == 0 {
+		return lines
+	}
+
+	doc := root.Content[0]
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key := doc.Content[i]
+		lines.keys[key.Value] = key.Line
+		if key.Value == "proxies" {
+			for _, item := range doc.Content[i+1].Content {
+				lines.proxies = append(lines.proxies, item.Line)
+			}
+		}
+	}
+	return lines
+}
+
+func decodeTOML(path string, data []byte, fc *fileConfig) error {
+	dec := toml.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(fc); err != nil {
+		var strictErr *toml.StrictMissingError
+		if errors.As(err, &strictErr) {
+			lines := tomlLines(data)
+			var errs []error
+			for _, e := range strictErr.Errors {
+				line, _ := e.Position()
+				key := e.Key()
+				errs = append(errs, &ConfigError{File: path, Line: line, Msg: unknownKey(key[:len(key)-1], key[len(key)-1], line, lines)})
+			}
+			return errors.Join(errs...)
+		}
+
+		var decodeErr *toml.DecodeError
+		if errors.As(err, &decodeErr) {
+			line, _ := decodeErr.Position()
+			msg := tomlTypePattern.ReplaceAllString(strings.TrimPrefix(decodeErr.Error(), "toml: "), "into $1")
+			if key := decodeErr.Key(); len(key) > 0 {
+				keyPath := append([]string(nil), key...)
+				if keyPath[0] == "proxies" {
+					keyPath[0] = fmt.Sprintf("proxies[%d]", tomlLines(data).proxyAt(line))
+				}
+				msg = strings.Join(keyPath, ".") + ": " + msg
+			}
+			return &ConfigError{File: path, Line: line, Msg: msg}
+		}
+		return &ConfigError{File: path, Msg: err.Error()}
+	}
+	return nil
+}
+
+// tomlLines finds top-level keys and tables and each [[proxies]] header.
+// Keys nested inside a table are ignored.
+var tomlTypePattern = regexp.MustCompile(`into struct field main\.\S+ of type (\S+)`)
+
+func tomlLines(data []byte) configLines {
+	lines := configLines{keys: make(map[string]int)}
+
+	inTable := false
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "[[proxies]]":
+			lines.proxies = append(lines.proxies, i+1)
+			inTable = true
+		case strings.HasPrefix(line, "["):
+			name := strings.Trim(line, "[] ")
+			if _, ok := lines.keys[name]; !ok {
+				lines.keys[name] = i + 1
+			}
+			inTable = true
+		case !inTable:
+			if key, _, ok := strings.Cut(line, "="); ok {
+				lines.keys[strings.TrimSpace(key)] = i + 1
+			}
+		}
+	}
+	return lines
+}
+
+// validate checks the decoded file against the schema and flattens the
+// global defaults into each proxy entry.
+func (fc *fileConfig) validate(path string, lines configLines) ([]ProxyConfig, error) {
+	var errs []error
+	invalid := func(line int, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{File: path, Line: line, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	switch {
+	case fc.Version == 0:
+		invalid(lines.keys["version"], "missing version (expected %d)", configVersion)
+	case fc.Version > configVersion:
+		invalid(lines.keys["version"], "unsupported version %d (this build understands up to %d)", fc.Version, configVersion)
+	}
+
+	if fc.Mode != "" && fc.Mode != "forward" && fc.Mode != "reverse" {
+		invalid(lines.keys["mode"], "mode must be \"forward\" or \"reverse\", got %q", fc.Mode)
+	}
+
+	dialTimeout, err := parseConfigDuration(fc.Timeouts.Dial)
+	if err != nil {
+		invalid(lines.keys["timeouts"], "timeouts.dial: %v", err)
+	}
+	idleTimeout, err := parseConfigDuration(fc.Timeouts.Idle)
+	if err != nil {
+		invalid(lines.keys["timeouts"], "timeouts.idle: %v", err)
+	}
+	if fc.Limits.MaxConnections < 0 {
+		invalid(lines.keys["limits"], "limits.max_connections must not be negative")
+	}
+	var health HealthCheck
+	if fc.Health != nil {
+		if health, err = fc.Health.healthCheck(); err != nil {
+			invalid(lines.keys["health"], "%v", err)
+		}
+	}
+
+	allow, err := parseCIDRs(fc.Access.Allow)
+	if err != nil {
+		invalid(lines.keys["access"], "access.allow: %v", err)
+	}
+	deny, err := parseCIDRs(fc.Access.Deny)
+	if err != nil {
+		invalid(lines.keys["access"], "access.deny: %v", err)
+	}
+
+	defaultHost := fc.DefaultHost
+	if addr, ok := fc.Hosts[defaultHost]; ok {
+		defaultHost = addr
+	}
+
+	var configs []ProxyConfig
+	seen := make(map[string]int)
+	for i, p := range fc.Proxies {
+		line := 0
+		if i < len(lines.proxies) {
+			line = lines.proxies[i]
+		}
+
+		cfg := ProxyConfig{
+			Host:           p.Host,
+			Port:           strconv.Itoa(p.Port),
+			TargetPort:     strconv.Itoa(p.TargetPort),
+			Protocol:       strings.ToLower(p.Protocol),
+			Description:    p.Description,
+			Bind:           p.Bind,
+			DialTimeout:    dialTimeout,
+			IdleTimeout:    idleTimeout,
+			MaxConnections: fc.Limits.MaxConnections,
+			Tags:           p.Tags,
+			Health:         health,
+			Allow:          allow,
+			Deny:           deny,
+		}
+
+		if p.TargetPort == 0 {
+			cfg.TargetPort = cfg.Port
+		}
+		if cfg.Protocol == "" {
+			cfg.Protocol = "tcp"
+		}
+		if cfg.Bind == "" {
+			cfg.Bind = fc.Bind
+		}
+		if addr, ok := fc.Hosts[cfg.Host]; ok {
+			cfg.Host = addr
+		}
+		if cfg.Host == "" {
+			cfg.Host = defaultHost
+		}
+
+		if !validPort(cfg.Port) {
+			invalid(line, "proxies[%d]: invalid port %d", i, p.Port)
+			continue
+		}
+		if !validPort(cfg.TargetPort) {
+			invalid(line, "proxies[%d]: invalid target_port %d", i, p.TargetPort)
+			continue
+		}
+		if cfg.Protocol != "tcp" && cfg.Protocol != "udp" {
+			invalid(line, "proxies[%d]: unsupported protocol %q", i, p.Protocol)
+			continue
+		}
+		if cfg.Protocol == "udp" {
+			// UDP entries are never probed, so the global health block skips them
+			cfg.Health = HealthCheck{}
+		}
+		if err := validBind(cfg.Bind); err != nil {
+			invalid(line, "proxies[%d]: %v", i, err)
+			continue
+		}
+
+		if p.Timeouts.Dial != "" {
+			if cfg.DialTimeout, err = parseConfigDuration(p.Timeouts.Dial); err != nil {
+				invalid(line, "proxies[%d]: timeouts.dial: %v", i, err)
+				continue
+			}
+		}
+		if p.Timeouts.Idle != "" {
+			if cfg.IdleTimeout, err = parseConfigDuration(p.Timeouts.Idle); err != nil {
+				invalid(line, "proxies[%d]: timeouts.idle: %v", i, err)
+				continue
+			}
+		}
+		if p.Limits.MaxConnections < 0 {
+			invalid(line, "proxies[%d]: limits.max_connections must not be negative", i)
+			continue
+		}
+		if p.Limits.MaxConnections > 0 {
+			cfg.MaxConnections = p.Limits.MaxConnections
+		}
+		if p.Health != nil {
+			if cfg.Health, err = p.Health.healthCheck(); err != nil {
+				invalid(line, "proxies[%d]: %v", i, err)
+				continue
+			}
+		}
+		// An entry's allow list replaces the global one, while deny lists add up
+		if len(p.Access.Allow) > 0 {
+			if cfg.Allow, err = parseCIDRs(p.Access.Allow); err != nil {
+				invalid(line, "proxies[%d]: access.allow: %v", i, err)
+				continue
+			}
+		}
+		if len(p.Access.Deny) > 0 {
+			entryDeny, err := parseCIDRs(p.Access.Deny)
+			if err != nil {
+				invalid(line, "proxies[%d]: access.deny: %v", i, err)
+				continue
+			}
+			cfg.Deny = append(append([]netip.Prefix(nil), deny...), entryDeny...)
+		}
+		if p.Auth != nil {
+			if cfg.Protocol == "udp" {
+				invalid(line, "proxies[%d]: auth only applies to tcp proxies", i)
+				continue
+			}
+			cfg.NoAuth = !*p.Auth
+		}
+		if p.Tunnel != nil {
+			if cfg.Protocol == "udp" {
+				invalid(line, "proxies[%d]: tunnel only applies to tcp proxies", i)
+				continue
+			}
+			cfg.NoTunnel = !*p.Tunnel
+		}
+		if p.Mux != nil {
+			if cfg.Protocol == "udp" {
+				invalid(line, "proxies[%d]: mux only applies to tcp proxies", i)
+				continue
+			}
+			cfg.NoMux = !*p.Mux
+		}
+		if p.TLS != nil {
+			if cfg.Protocol == "udp" {
+				invalid(line, "proxies[%d]: tls only applies to tcp proxies", i)
+				continue
+			}
+			if (p.TLS.Cert == "") != (p.TLS.Key == "") {
+				invalid(line, "proxies[%d]: tls needs both cert and key, or neither to use the local CA", i)
+				continue
+			}
+			if p.TLS.Cert != "" && len(p.TLS.Hosts) > 0 {
+				invalid(line, "proxies[%d]: tls.hosts only applies to certificates from the local CA", i)
+				continue
+			}
+			// Relative paths are taken from the config file's directory
+			cfg.TLS = &ListenTLS{Hosts: p.TLS.Hosts}
+			if p.TLS.Cert != "" {
+				cfg.TLS.Cert = configRelative(path, p.TLS.Cert)
+				cfg.TLS.Key = configRelative(path, p.TLS.Key)
+			}
+		}
+		if t := p.UpstreamTLS; t != nil {
+			if cfg.Protocol == "udp" {
+				invalid(line, "proxies[%d]: upstream_tls only applies to tcp proxies", i)
+				continue
+			}
+			if (t.Cert == "") != (t.Key == "") {
+				invalid(line, "proxies[%d]: upstream_tls needs both cert and key for a client certificate", i)
+				continue
+			}
+			// server_name is still sent as SNI, which routes the connection
+			if t.InsecureSkipVerify && t.CA != "" {
+				invalid(line, "proxies[%d]: upstream_tls: insecure_skip_verify ignores ca", i)
+				continue
+			}
+			cfg.UpstreamTLS = &UpstreamTLS{
+				ServerName:         t.ServerName,
+				CA:                 configRelative(path, t.CA),
+				Cert:               configRelative(path, t.Cert),
+				Key:                configRelative(path, t.Key),
+				InsecureSkipVerify: t.InsecureSkipVerify,
+			}
+		}
+		if p.Health != nil && cfg.Protocol == "udp" {
+			invalid(line, "proxies[%d]: health checks are only supported for tcp proxies", i)
+			continue
+		}
+
+		if len(p.Upstreams) > 0 {
+			if p.Host != "" {
+				invalid(line, "proxies[%d]: host and upstreams cannot both be set", i)
+				continue
+			}
+			if cfg.Protocol == "udp" {
+				invalid(line, "proxies[%d]: upstreams are only supported for tcp proxies", i)
+				continue
+			}
+			if cfg.Upstreams, err = parseUpstreams(p.Upstreams, cfg.TargetPort, defaultHost, fc.Hosts); err != nil {
+				invalid(line, "proxies[%d]: %v", i, err)
+				continue
+			}
+			// Left empty while any upstream still needs the default host, which
+			// is then asked for like it is for entries without a host
+			cfg.Host = cfg.Upstreams[0].Host
+			for _, u := range cfg.Upstreams {
+				if u.Host == "" {
+					cfg.Host = ""
+				}
+			}
+		}
+		if cfg.Balance = strings.ToLower(p.Balance); cfg.Balance != "" {
+			if !validBalance(cfg.Balance) {
+				invalid(line, "proxies[%d]: balance must be round-robin, least-connections, random or failover, got %q", i, p.Balance)
+				continue
+			}
+			if len(cfg.Upstreams) < 2 {
+				invalid(line, "proxies[%d]: balance needs at least two upstreams", i)
+				continue
+			}
+		}
+		if p.Failback != "" || p.FailbackDelay != "" {
+			if cfg.Balance != "failover" {
+				invalid(line, "proxies[%d]: failback and failback_delay only apply to balance: failover", i)
+				continue
+			}
+			cfg.Failback = strings.ToLower(p.Failback)
+			if cfg.Failback != "" && cfg.Failback != "auto" && cfg.Failback != "manual" {
+				invalid(line, "proxies[%d]: failback must be auto or manual, got %q", i, p.Failback)
+				continue
+			}
+			if cfg.FailbackDelay, err = parseConfigDuration(p.FailbackDelay); err != nil {
+				invalid(line, "proxies[%d]: failback_delay: %v", i, err)
+				continue
+			}
+		}
+
+		if first, dup := seen[cfg.Key()]; dup {
+			invalid(line, "proxies[%d]: port %s is already configured by proxies[%d]", i, cfg.Key(), first)
+			continue
+		}
+		seen[cfg.Key()] = i
+
+		configs = append(configs, cfg)
+	}
+
+	return configs, errors.Join(errs...)
+}
+
+// parseUpstreams reads entries of the form host, host:port or :port. A
+// missing port means targetPort and a missing host means defaultHost; host
+// aliases are expanded.
+func parseUpstreams(specs []string, targetPort, defaultHost string, aliases map[string]string) ([]Upstream, error) {
+	upstreams := make([]Upstream, 0, len(specs))
+	seen := make(map[Upstream]bool)
+	for _, spec := range specs {
+		u := Upstream{Host: spec, Port: targetPort}
+		if host, port, err := net.SplitHostPort(spec); err == nil {
+			u.Host, u.Port = host, port
+		}
+		if addr, ok := aliases[u.Host]; ok {
+			u.Host = addr
+		}
+		if u.Host == "" {
+			u.Host = defaultHost
+		}
+
+		if !validPort(u.Port) {
+			return nil, fmt.Errorf("upstream %q has an invalid port", spec)
+		}
+		if strings.ContainsAny(u.Host, "[]") {
+			return nil, fmt.Errorf("upstream %q is not host, host:port or :port", spec)
+		}
+		if seen[u] {
+			return nil, fmt.Errorf("upstream %q is listed twice", spec)
+		}
+		seen[u] = true
+		upstreams = append(upstreams, u)
+	}
+	return upstreams, nil
+}
+
+func parseConfigDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("must not be negative")
+	}
+	return d, nil
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes content to a file called name in a fresh directory and
+// returns its path.
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// configErr is err's message with the config file's path shortened to "cfg".
+func configErr(err error, path string) string {
+	if err == nil {
+		return ""
+	}
+	return strings.ReplaceAll(err.Error(), path, "cfg")
+}
+
+func TestParseConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []ProxyConfig
+		wantErr string
+	}{
+		{
+			name:    "ports and descriptions",
+			content: "# comment\n\n5432:Postgres\n6379\n",
+			want: []ProxyConfig{
+				{Port: "5432", TargetPort: "5432", Protocol: "tcp", Description: "Postgres"},
+				{Port: "6379", TargetPort: "6379", Protocol: "tcp"},
+			},
+		},
+		{
+			name:    "protocol and port mapping",
+			content: "53/udp:DNS\n13000->3000:App\n",
+			want: []ProxyConfig{
+				{Port: "53", TargetPort: "53", Protocol: "udp", Description: "DNS"},
+				{Port: "13000", TargetPort: "3000", Protocol: "tcp", Description: "App"},
+			},
+		},
+		{
+			name:    "hosts per entry and per section",
+			content: "db-box:5432:Postgres\n[fd7a::1]:22\n[host cache]\n6379\n",
+			want: []ProxyConfig{
+				{Host: "db-box", Port: "5432", TargetPort: "5432", Protocol: "tcp", Description: "Postgres"},
+				{Host: "fd7a::1", Port: "22", TargetPort: "22", Protocol: "tcp"},
+				{Host: "cache", Port: "6379", TargetPort: "6379", Protocol: "tcp"},
+			},
+		},
+		{
+			name:    "same port over tcp and udp",
+			content: "53\n53/udp\n",
+			want: []ProxyConfig{
+				{Port: "53", TargetPort: "53", Protocol: "tcp"},
+				{Port: "53", TargetPort: "53", Protocol: "udp"},
+			},
+		},
+		{
+			name:    "invalid port",
+			content: "5432\n70000:Too high\n",
+			want:    []ProxyConfig{{Port: "5432", TargetPort: "5432", Protocol: "tcp"}},
+			wantErr: `cfg:2: invalid port "70000"`,
+		},
+		{
+			name:    "invalid target port",
+			content: "8080->0\n",
+			wantErr: `cfg:1: invalid target port "0"`,
+		},
+		{
+			name:    "unsupported protocol",
+			content: "53/sctp\n",
+			wantErr: `cfg:1: unsupported protocol "sctp"`,
+		},
+		{
+			name:    "duplicate port",
+			content: "5432\n\n5432:Again\n",
+			want:    []ProxyConfig{{Port: "5432", TargetPort: "5432", Protocol: "tcp"}},
+			wantErr: "cfg:3: port 5432 is already configured on line 1",
+		},
+		{
+			name:    "auth needs a structured config",
+			content: "auth:8080:Login service\nauth: false\nAuth=false\n",
+			want:    []ProxyConfig{{Host: "auth", Port: "8080", TargetPort: "8080", Protocol: "tcp", Description: "Login service"}},
+			wantErr: "cfg:2: auth is only supported in .proxy.yaml and .proxy.toml\ncfg:3: auth is only supported in .proxy.yaml and .proxy.toml",
+		},
+		{
+			name:    "access lists need a structured config",
+			content: "allow: 100.64.0.0/10\n[host gpu]\ndeny 100.64.0.7\n",
+			wantErr: "cfg:1: allow is only supported in .proxy.yaml and .proxy.toml\ncfg:3: deny is only supported in .proxy.yaml and .proxy.toml",
+		},
+		{
+			name:    "every error is reported",
+			content: "x\n53/sctp\n",
+			wantErr: "cfg:1: invalid port \"x\"\ncfg:2: unsupported protocol \"sctp\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, ".proxy.conf", tt.content)
+			got, err := parseConfigFile(path)
+			if msg := configErr(err, path); msg != tt.wantErr {
+				t.Errorf("error = %q, want %q", msg, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("configs = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseStructuredConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		wantMode string
+		want     []ProxyConfig
+		wantErr  string
+	}{
+		{
+			name: "yaml defaults and overrides",
+			file: ".proxy.yaml",
+			content: `version: 1
+mode: forward
+default_host: db
+hosts:
+  db: 10.0.0.5
+bind: 127.0.0.1
+timeouts:
+  dial: 2s
+limits:
+  max_connections: 10
+access:
+  allow: [10.0.0.0/8]
+  deny: [10.0.0.1]
+proxies:
+  - port: 5432
+    description: Postgres
+    tags: [db]
+  - port: 8080
+    target_port: 80
+    host: web
+    bind: tailscale0
+    timeouts:
+      idle: 1m
+    limits:
+      max_connections: 2
+    access:
+      allow: [192.168.0.0/16]
+      deny: [192.168.0.9]
+`,
+			wantMode: "forward",
+			want: []ProxyConfig{
+				{
+					Host: "10.0.0.5", Port: "5432", TargetPort: "5432", Protocol: "tcp", Description: "Postgres",
+					Bind: "127.0.0.1", DialTimeout: 2 * time.Second, MaxConnections: 10, Tags: []string{"db"},
+					Allow: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+					Deny:  []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")},
+				},
+				{
+					Host: "web", Port: "8080", TargetPort: "80", Protocol: "tcp",
+					Bind: "tailscale0", DialTimeout: 2 * time.Second, IdleTimeout: time.Minute, MaxConnections: 2,
+					Allow: []netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")},
+					Deny:  []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32"), netip.MustParsePrefix("192.168.0.9/32")},
+				},
+			},
+		},
+		{
+			name: "toml defaults and overrides",
+			file: ".proxy.toml",
+			content: `version = 1
+mode = "reverse"
+
+[timeouts]
+idle = "30s"
+
+[[proxies]]
+port = 53
+protocol = "UDP"
+description = "DNS"
+
+[[proxies]]
+port = 5432
+[proxies.timeouts]
+idle = "5m"
+`,
+			wantMode: "reverse",
+			want: []ProxyConfig{
+				{Port: "53", TargetPort: "53", Protocol: "udp", Description: "DNS", IdleTimeout: 30 * time.Second},
+				{Port: "5432", TargetPort: "5432", Protocol: "tcp", IdleTimeout: 5 * time.Minute},
+			},
+		},
+		{
+			name: "toml upstreams and failover",
+			file: ".proxy.toml",
+			content: `version = 1
+default_host = "a"
+
+[hosts]
+b = "10.0.0.2"
+
+[[proxies]]
+port = 5432
+upstreams = ["a", "b:6432", ":7432"]
+balance = "failover"
+failback = "manual"
+failback_delay = "30s"
+`,
+			want: []ProxyConfig{{
+				Host: "a", Port: "5432", TargetPort: "5432", Protocol: "tcp",
+				Upstreams: []Upstream{{Host: "a", Port: "5432"}, {Host: "10.0.0.2", Port: "6432"}, {Host: "a", Port: "7432"}},
+				Balance:   "failover", Failback: "manual", FailbackDelay: 30 * time.Second,
+			}},
+		},
+		{
+			name: "yaml health checks",
+			file: ".proxy.yaml",
+			content: `version: 1
+health:
+  interval: 5s
+proxies:
+  - port: 5432
+  - port: 8080
+    health:
+      type: http
+      timeout: 1s
+`,
+			want: []ProxyConfig{
+				{Port: "5432", TargetPort: "5432", Protocol: "tcp", Health: HealthCheck{Type: "tcp", Interval: 5 * time.Second}},
+				{Port: "8080", TargetPort: "8080", Protocol: "tcp", Health: HealthCheck{Type: "http", Timeout: time.Second, Path: "/"}},
+			},
+		},
+		{
+			name: "global health skips udp entries",
+			file: ".proxy.yaml",
+			content: `version: 1
+health:
+  interval: 5s
+proxies:
+  - port: 5432
+  - port: 53
+    protocol: udp
+`,
+			want: []ProxyConfig{
+				{Port: "5432", TargetPort: "5432", Protocol: "tcp", Health: HealthCheck{Type: "tcp", Interval: 5 * time.Second}},
+				{Port: "53", TargetPort: "53", Protocol: "udp"},
+			},
+		},
+		{
+			name: "tls paths are relative to the config file",
+			file: ".proxy.yaml",
+			content: `version: 1
+proxies:
+  - port: 443
+    target_port: 8080
+    tls:
+      cert: cert.pem
+      key: key.pem
+  - port: 8443
+    tls:
+      hosts: [app.internal]
+  - port: 9443
+    upstream_tls:
+      server_name: app.internal
+      insecure_skip_verify: true
+`,
+			want: []ProxyConfig{
+				{Port: "443", TargetPort: "8080", Protocol: "tcp", TLS: &ListenTLS{Cert: "DIR/cert.pem", Key: "DIR/key.pem"}},
+				{Port: "8443", TargetPort: "8443", Protocol: "tcp", TLS: &ListenTLS{Hosts: []string{"app.internal"}}},
+				{Port: "9443", TargetPort: "9443", Protocol: "tcp", UpstreamTLS: &UpstreamTLS{ServerName: "app.internal", InsecureSkipVerify: true}},
+			},
+		},
+		{
+			name:    "missing version",
+			file:    ".proxy.yaml",
+			content: "proxies:\n  - port: 5432\n",
+			want:    []ProxyConfig{{Port: "5432", TargetPort: "5432", Protocol: "tcp"}},
+			wantErr: "cfg: missing version (expected 1)",
+		},
+		{
+			name:    "newer version",
+			file:    ".proxy.toml",
+			content: "version = 2\n",
+			wantErr: "cfg:1: unsupported version 2 (this build understands up to 1)",
+		},
+		{
+			name:     "unknown mode",
+			file:     ".proxy.yaml",
+			content:  "version: 1\nmode: sideways\n",
+			wantMode: "sideways",
+			wantErr:  `cfg:2: mode must be "forward" or "reverse", got "sideways"`,
+		},
+		{
+			name:    "yaml unknown top-level key",
+			file:    ".proxy.yaml",
+			content: "version: 1\nbogus: true\n",
+			wantErr: `cfg:2: unknown key "bogus"`,
+		},
+		{
+			name:    "yaml unknown key in an entry",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 5432\n  - port: 6379\n    bogus: true\n",
+			wantErr: `cfg:5: proxies[1]: unknown key "bogus"`,
+		},
+		{
+			name:    "yaml unknown key in an entry's block",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 5432\n    health:\n      bogus: 1\n",
+			wantErr: `cfg:5: proxies[0].health: unknown key "bogus"`,
+		},
+		{
+			name:    "yaml unknown key in a global block",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 5432\nhealth:\n  bogus: 1\n",
+			wantErr: `cfg:5: health: unknown key "bogus"`,
+		},
+		{
+			name:    "yaml wrong type",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: [1]\n",
+			wantErr: "cfg:3: cannot unmarshal !!seq into int",
+		},
+		{
+			name:    "toml unknown key in an entry",
+			file:    ".proxy.toml",
+			content: "version = 1\n\n[[proxies]]\nport = 5432\n\n[[proxies]]\nport = 6379\nbogus = true\n",
+			wantErr: `cfg:8: proxies[1]: unknown key "bogus"`,
+		},
+		{
+			name:    "toml wrong type",
+			file:    ".proxy.toml",
+			content: "version = 1\n\n[[proxies]]\nport = \"x\"\n",
+			wantErr: "cfg:4: proxies[0].port: cannot decode TOML string into int",
+		},
+		{
+			name:    "invalid entries",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 0\n  - port: 53\n    protocol: sctp\n  - port: 80\n  - port: 80\n",
+			want:    []ProxyConfig{{Port: "80", TargetPort: "80", Protocol: "tcp"}},
+			wantErr: "cfg:3: proxies[0]: invalid port 0\n" +
+				"cfg:4: proxies[1]: unsupported protocol \"sctp\"\n" +
+				"cfg:7: proxies[3]: port 80 is already configured by proxies[2]",
+		},
+		{
+			name:    "health on a udp entry",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 53\n    protocol: udp\n    health: {}\n",
+			wantErr: "cfg:3: proxies[0]: health checks are only supported for tcp proxies",
+		},
+		{
+			name:    "invalid health checks",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 80\n    health:\n      type: ping\n  - port: 81\n    health:\n      type: http\n      path: healthz\n  - port: 82\n    health:\n      type: expect\n",
+			wantErr: "cfg:3: proxies[0]: health.type must be tcp, http or expect, got \"ping\"\n" +
+				"cfg:6: proxies[1]: health.path must start with /, got \"healthz\"\n" +
+				"cfg:10: proxies[2]: health type expect needs send and/or expect",
+		},
+		{
+			name:    "tls on a udp entry",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 53\n    protocol: udp\n    tls: {}\n",
+			wantErr: "cfg:3: proxies[0]: tls only applies to tcp proxies",
+		},
+		{
+			name:    "tls cert without key",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 443\n    tls:\n      cert: cert.pem\n  - port: 8443\n    tls:\n      cert: cert.pem\n      key: key.pem\n      hosts: [app.internal]\n",
+			wantErr: "cfg:3: proxies[0]: tls needs both cert and key, or neither to use the local CA\n" +
+				"cfg:6: proxies[1]: tls.hosts only applies to certificates from the local CA",
+		},
+		{
+			name:    "insecure_skip_verify with a ca",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 443\n    upstream_tls:\n      ca: ca.pem\n      insecure_skip_verify: true\n",
+			wantErr: "cfg:3: proxies[0]: upstream_tls: insecure_skip_verify ignores ca",
+		},
+		{
+			name:    "host with upstreams",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 80\n    host: a\n    upstreams: [b, c]\n",
+			wantErr: "cfg:3: proxies[0]: host and upstreams cannot both be set",
+		},
+		{
+			name:    "invalid upstreams",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 80\n    upstreams: [a, a]\n  - port: 81\n    upstreams: [\"b:0\"]\n  - port: 53\n    protocol: udp\n    upstreams: [a, b]\n",
+			wantErr: "cfg:3: proxies[0]: upstream \"a\" is listed twice\n" +
+				"cfg:5: proxies[1]: upstream \"b:0\" has an invalid port\n" +
+				"cfg:7: proxies[2]: upstreams are only supported for tcp proxies",
+		},
+		{
+			name:    "balance with one upstream",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 80\n    upstreams: [a]\n    balance: random\n  - port: 81\n    upstreams: [a, b]\n    balance: fastest\n",
+			wantErr: "cfg:3: proxies[0]: balance needs at least two upstreams\n" +
+				"cfg:6: proxies[1]: balance must be round-robin, least-connections, random or failover, got \"fastest\"",
+		},
+		{
+			name:    "failback without failover",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 80\n    upstreams: [a, b]\n    failback: manual\n  - port: 81\n    upstreams: [a, b]\n    balance: failover\n    failback: later\n",
+			wantErr: "cfg:3: proxies[0]: failback and failback_delay only apply to balance: failover\n" +
+				"cfg:6: proxies[1]: failback must be auto or manual, got \"later\"",
+		},
+		{
+			name:    "invalid durations and limits",
+			file:    ".proxy.yaml",
+			content: "version: 1\ntimeouts:\n  dial: soon\nlimits:\n  max_connections: -1\nproxies:\n  - port: 80\n    timeouts:\n      idle: -1s\n",
+			wantErr: "cfg:2: timeouts.dial: time: invalid duration \"soon\"\n" +
+				"cfg:4: limits.max_connections must not be negative\n" +
+				"cfg:7: proxies[0]: timeouts.idle: must not be negative",
+		},
+		{
+			name:    "invalid bind",
+			file:    ".proxy.yaml",
+			content: "version: 1\nproxies:\n  - port: 80\n    bind: 10.0.0.0/33\n",
+			wantErr: `cfg:3: proxies[0]: bind must be an IP address, interface name or CIDR, got "10.0.0.0/33"`,
+		},
+		{
+			name:    "invalid global access list",
+			file:    ".proxy.yaml",
+			content: "version: 1\naccess:\n  allow: [nope]\nproxies:\n  - port: 80\n",
+			want:    []ProxyConfig{{Port: "80", TargetPort: "80", Protocol: "tcp"}},
+			wantErr: `cfg:2: access.allow: invalid CIDR or IP address "nope"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, tt.file, tt.content)
+			mode, got, err := parseStructuredConfig(path)
+			if msg := configErr(err, path); msg != tt.wantErr {
+				t.Errorf("error = %q, want %q", msg, tt.wantErr)
+			}
+			if mode != tt.wantMode {
+				t.Errorf("mode = %q, want %q", mode, tt.wantMode)
+			}
+			for _, cfg := range got {
+				if cfg.TLS != nil && cfg.TLS.Cert != "" {
+					cfg.TLS.Cert = strings.Replace(cfg.TLS.Cert, filepath.Dir(path), "DIR", 1)
+					cfg.TLS.Key = strings.Replace(cfg.TLS.Key, filepath.Dir(path), "DIR", 1)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("configs = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	ctlSocket      string
+	ctlJSON        bool
+	ctlUDP         bool
+	ctlDescription string
+)
+
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Control a running proxy through its admin API",
+	Long: `Control a running proxy through the admin API it serves on a local socket.
+By default this talks to the socket a proxy opens for the current user; use
+--socket when the instance was started with --admin-addr.`,
+}
+
+var ctlLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List proxies",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var proxies []proxyInfo
+		raw, err := newCtlClient().do(http.MethodGet, "/proxies", nil, &proxies)
+		if err != nil || ctlJSON {
+			return printRaw(raw, err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PORT\tUPSTREAM\tDESCRIPTION\tSTATUS\tACTIVE\tTOTAL\tIN\tOUT")
+		for _, p := range proxies {
+			var upstreams []string
+			for _, u := range p.Upstreams {
+				upstreams = append(upstreams, u.Addr)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\n", p.Key, strings.Join(upstreams, ","),
+				p.Description, p.Status, p.ActiveConnections, p.TotalConnections, formatBytes(p.BytesIn), formatBytes(p.BytesOut))
+		}
+		return w.Flush()
+	},
+}
+
+var ctlAddCmd = &cobra.Command{
+	Use:   "add <port> [host:]<targetPort>",
+	Short: "Start a proxy",
+	Long: `Start a proxy on the running instance, in that instance's mode. In forward
+mode the target is host:port on the remote side, or just a port to use the
+instance's default host; in reverse mode it is the local service's port.`,
+	Example: `  proxy ctl add 5432 db:5432
+  proxy ctl add 8053 53 --udp -d "Local DNS"`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		req := addProxyRequest{
+			Port:        json.Number(args[0]),
+			TargetPort:  json.Number(args[1]),
+			Description: ctlDescription,
+		}
+		if host, port, err := net.SplitHostPort(args[1]); err == nil {
+			req.Host, req.TargetPort = host, json.Number(port)
+		}
+		if ctlUDP {
+			req.Protocol = "udp"
+		}
+
+		var p proxyInfo
+		raw, err := newCtlClient().do(http.MethodPost, "/proxies", req, &p)
+		if err != nil || ctlJSON {
+			return printRaw(raw, err)
+		}
+		var upstreams []string
+		for _, u := range p.Upstreams {
+			upstreams = append(upstreams, u.Addr)
+		}
+		fmt.Printf("Started %s -> %s\n", p.Key, strings.Join(upstreams, ", "))
+		return nil
+	},
+}
+
+var ctlRmCmd = &cobra.Command{
+	Use:   "rm <port>",
+	Short: "Stop a proxy and let its connections drain",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		raw, err := newCtlClient().do(http.MethodDelete, proxyPath(args[0], ""), nil, nil)
+		if err != nil || ctlJSON {
+			return printRaw(raw, err)
+		}
+		fmt.Printf("Stopped %s\n", args[0])
+		return nil
+	},
+}
+
+var ctlRestartCmd = &cobra.Command{
+	Use:   "restart <port>",
+	Short: "Restart a proxy with the same settings",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		raw, err := newCtlClient().do(http.MethodPost, proxyPath(args[0], "/restart"), nil, nil)
+		if err != nil || ctlJSON {
+			return printRaw(raw, err)
+		}
+		fmt.Printf("Restarted %s\n", args[0])
+		return nil
+	},
+}
+
+var ctlFailbackCmd = &cobra.Command{
+	Use:   "failback <port>",
+	Short: "Move a failover proxy back to its primary",
+	Long: `Move a failover proxy back to the earliest healthy upstream before the one
+serving it, which is how proxies with failback: manual return to the primary.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var resp struct {
+			Serving string `json:"serving"`
+		}
+		raw, err := newCtlClient().do(http.MethodPost, proxyPath(args[0], "/failback"), nil, &resp)
+		if err != nil || ctlJSON {
+			return printRaw(raw, err)
+		}
+		fmt.Printf("%s is served by %s\n", args[0], resp.Serving)
+		return nil
+	},
+}
+
+var ctlConnsCmd = &cobra.Command{
+	Use:   "conns [port]",
+	Short: "List live connections, optionally for one proxy",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := "/connections"
+		if len(args) == 1 {
+			path += "?proxy=" + url.QueryEscape(args[0])
+		}
+
+		var conns []connInfoJSON
+		raw, err := newCtlClient().do(http.MethodGet, path, nil, &conns)
+		if err != nil || ctlJSON {
+			return printRaw(raw, err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tPROXY\tCLIENT\tUPSTREAM\tPEER\tAGE\tIN\tOUT\tIDLE")
+		for _, c := range conns {
+			peer := c.Peer
+			if peer == "" {
+				peer = "-"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.ID, c.Proxy, c.Client, c.Upstream, peer,
+				time.Since(c.Started).Round(time.Second), formatBytes(c.BytesIn), formatBytes(c.BytesOut),
+				time.Since(c.LastActivity).Round(time.Second))
+		}
+		return w.Flush()
+	},
+}
+
+var ctlKillCmd = &cobra.Command{
+	Use:   "kill <id>...",
+	Short: "Close live connections by ID",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client := newCtlClient()
+		for _, id := range args {
+			if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+				return fmt.Errorf("invalid connection id %q", id)
+			}
+			raw, err := client.do(http.MethodDelete, "/connections/"+id, nil, nil)
+			if err != nil {
+				return fmt.Errorf("connection %s: %v", id, err)
+			}
+			if ctlJSON {
+				if err := printRaw(raw, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			fmt.Printf("Closed connection %s\n", id)
+		}
+		return nil
+	},
+}
+
+func init() {
+	ctlCmd.PersistentFlags().StringVar(&ctlSocket, "socket", defaultAdminSocket(), "Admin API socket path or address of the running proxy")
+	ctlCmd.PersistentFlags().BoolVar(&ctlJSON, "json", false, "Print the raw JSON response")
+	ctlAddCmd.Flags().BoolVar(&ctlUDP, "udp", false, "Proxy UDP instead of TCP")
+	ctlAddCmd.Flags().StringVarP(&ctlDescription, "description", "d", "", "Description shown in the dashboard")
+
+	for _, cmd := range []*cobra.Command{ctlLsCmd, ctlAddCmd, ctlRmCmd, ctlRestartCmd, ctlFailbackCmd, ctlConnsCmd, ctlKillCmd} {
+		// Errors are API answers, not usage mistakes; main prints them
+		cmd.SilenceUsage = true
+		cmd.SilenceErrors = true
+		ctlCmd.AddCommand(cmd)
+	}
+}
+
+// proxyPath maps a port argument such as 5432 or 53/udp to its admin API
+// path, with action appended to the port.
+func proxyPath(arg, action string) string {
+	port, proto, _ := strings.Cut(arg, "/")
+	path := "/proxies/" + url.PathEscape(port) + action
+	if strings.EqualFold(proto, "udp") {
+		path += "?protocol=udp"
+	}
+	return path
+}
+
+func printRaw(raw []byte, err error) error {
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(raw)
+	return err
+}
+
+// ctlClient talks to the admin API of a running instance.
+type ctlClient struct {
+	addr   string
+	client *http.Client
+}
+
+func newCtlClient() *ctlClient {
+	addr := ctlSocket
+	transport := &http.Transport{}
+	if socket := ctlSocket; strings.ContainsRune(socket, os.PathSeparator) || strings.HasSuffix(socket, ".sock") {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			if err := checkSocketOwner(socket); err != nil {
+				return nil, err
+			}
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+		addr = "proxy"
+	}
+	return &ctlClient{addr: addr, client: &http.Client{Transport: transport, Timeout: 10 * time.Second}}
+}
+
+// checkSocketOwner refuses a socket another user created. Without
+// XDG_RUNTIME_DIR the default socket is in the shared temp dir, where anyone
+// could have put one first to collect our requests.
+func checkSocketOwner(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if uid, ok := fileOwner(info); ok && uid != os.Getuid() {
+		return fmt.Errorf("%s belongs to another user", path)
+	}
+	return nil
+}
+
+// do sends a request with body encoded as JSON and decodes the response
+// into out, returning the raw response too. API errors are returned with the
+// message the server sent.
+func (c *ctlClient) do(method, path string, body, out interface{}) ([]byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://"+c.addr+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("no running proxy at %s (is it started, or does it use --admin-addr?): %v", ctlSocket, err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(raw, &apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("%s", apiErr.Error)
+		}
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	if out != nil && len(raw) > 0 {
+		if err := json.Unmarshal(raw, out); err != nil {
+			return nil, fmt.Errorf("unexpected response: %v", err)
+		}
+	}
+	return raw, nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	// upstreamCheckInterval is how often a reachable upstream is re-checked
+	// when the entry doesn't set its own health interval.
+	upstreamCheckInterval = 10 * time.Second
+
+	// Unreachable upstreams are retried with exponential backoff between
+	// these bounds.
+	upstreamRetryMin = time.Second
+	upstreamRetryMax = 30 * time.Second
+
+	// upstreamProbeTimeout bounds a check when the entry sets neither a
+	// health timeout nor a dial timeout.
+	upstreamProbeTimeout = 5 * time.Second
+
+	// maxExpectRead caps how much of the upstream's reply an expect check
+	// reads while looking for the expected string.
+	maxExpectRead = 64 * 1024
+)
+
+// HealthCheck describes how an upstream is probed. The zero value is a plain
+// TCP connect check on the default interval.
+type HealthCheck struct {
+	Type     string // "tcp", "http" or "expect"; empty means tcp
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// http checks
+	Path         string
+	ExpectStatus int // 0 accepts any 2xx or 3xx response
+
+	// expect checks
+	Send   string
+	Expect string
+}
+
+// probe runs one check against targetAddr, connecting the way clients are
+// connected, and reports how long it took.
+func (h HealthCheck) probe(targetAddr string, timeout time.Duration, dial dialFunc) (time.Duration, error) {
+	start := time.Now()
+
+	var err error
+	switch h.Type {
+	case "http":
+		err = h.probeHTTP(targetAddr, timeout, dial)
+	case "expect":
+		err = h.probeExpect(targetAddr, timeout, dial)
+	default:
+		var conn net.Conn
+		conn, err = dial(targetAddr, timeout)
+		if err == nil {
+			conn.Close()
+		}
+	}
+	return time.Since(start), err
+}
+
+func (h HealthCheck) probeHTTP(targetAddr string, timeout time.Duration, dial dialFunc) error {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dial(addr, timeout)
+			},
+			DisableKeepAlives: true,
+		},
+		// A redirect is an answer, there is no need to follow it
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get("http://" + targetAddr + h.Path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxExpectRead))
+
+	if h.ExpectStatus != 0 {
+		if resp.StatusCode != h.ExpectStatus {
+			return fmt.Errorf("GET %s returned %d, expected %d", h.Path, resp.StatusCode, h.ExpectStatus)
+		}
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("GET %s returned %d", h.Path, resp.StatusCode)
+	}
+	return nil
+}
+
+func (h HealthCheck) probeExpect(targetAddr string, timeout time.Duration, dial dialFunc) error {
+	conn, err := dial(targetAddr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if h.Send != "" {
+		if _, err := io.WriteString(conn, h.Send); err != nil {
+			return err
+		}
+	}
+	if h.Expect == "" {
+		return nil
+	}
+
+	expect := []byte(h.Expect)
+	var reply []byte
+	buf := make([]byte, 4096)
+	for len(reply) < maxExpectRead {
+		n, err := conn.Read(buf)
+		reply = append(reply, buf[:n]...)
+		if bytes.Contains(reply, expect) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("expected %q, got %q: %v", h.Expect, truncate(reply, 64), err)
+		}
+	}
+	return fmt.Errorf("expected %q in the first %d bytes of the reply", h.Expect, maxExpectRead)
+}
+
+func truncate(b []byte, n int) []byte {
+	if len(b) > n {
+		return b[:n]
+	}
+	return b
+}
+
+// monitorUpstream probes one of the proxy's upstreams in the background
+// using the entry's health check, so the status moves between Waiting,
+// Active and Degraded as services come and go. It returns once the proxy is
+// stopped.
+func (pm *ProxyManager) monitorUpstream(rp *runningProxy, u *upstream) {
+	check := rp.cfg.Health
+	timeout := check.Timeout
+	if timeout == 0 {
+		timeout = rp.cfg.DialTimeout
+	}
+	if timeout == 0 {
+		timeout = upstreamProbeTimeout
+	}
+	interval := check.Interval
+	if interval == 0 {
+		interval = upstreamCheckInterval
+	}
+
+	backoff := upstreamRetryMin
+	for {
+		latency, err := check.probe(u.addr, timeout, pm.dialer(rp))
+		pm.recordHealth(rp, u, latency, err)
+		pm.reportUpstream(rp, u, err)
+
+		wait := interval
+		if err != nil {
+			wait = min(backoff, interval)
+			backoff = min(backoff*2, upstreamRetryMax)
+		} else {
+			backoff = upstreamRetryMin
+		}
+
+		select {
+		case <-rp.stopCh:
+			return
+		case <-u.recheck:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// recordHealth stores the outcome of a health check in the upstream's stats
+// and refreshes the proxy-wide summary.
+func (pm *ProxyManager) recordHealth(rp *runningProxy, u *upstream, latency time.Duration, err error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	us := u.stats
+	us.HealthCheckedAt = time.Now()
+	us.HealthLatency = latency
+	if err != nil {
+		us.HealthStatus = "unhealthy"
+		us.HealthFailures++
+		us.HealthError = err.Error()
+	} else {
+		us.HealthStatus = "healthy"
+		us.HealthFailures = 0
+		us.HealthError = ""
+	}
+
+	summarizeHealth(rp.stats)
+}
+
+// summarizeHealth sets a proxy's health fields from its upstreams: a proxy is
+// as healthy as its healthiest upstream.
+func summarizeHealth(stats *ProxyStats) {
+	var best *UpstreamStats
+	for i := range stats.Upstreams {
+		us := &stats.Upstreams[i]
+		switch {
+		case us.HealthStatus == "":
+		case best == nil,
+			us.HealthFailures < best.HealthFailures,
+			us.HealthFailures == best.HealthFailures && us.HealthLatency < best.HealthLatency:
+			best = us
+		}
+	}
+	if best == nil {
+		return
+	}
+
+	stats.HealthStatus = best.HealthStatus
+	stats.HealthCheckedAt = best.HealthCheckedAt
+	stats.HealthLatency = best.HealthLatency
+	stats.HealthFailures = best.HealthFailures
+	stats.HealthError = best.HealthError
+}
+
+// reportDial records the outcome of dialing an upstream for a client. A
+// failed dial marks the upstream down straight away; a successful one only
+// asks its monitor to re-check, since a health check may demand more than
+// an open port.
+func (pm *ProxyManager) reportDial(rp *runningProxy, u *upstream, err error) {
+	if err != nil {
+		pm.reportUpstream(rp, u, err)
+		return
+	}
+
+	pm.mu.RLock()
+	status := rp.stats.Status
+	pm.mu.RUnlock()
+	if status == "Active" {
+		return
+	}
+
+	select {
+	case u.recheck <- struct{}{}:
+	default:
+	}
+}
+
+// reportUpstream records whether an upstream is usable, logging transitions
+// and updating the proxy status: Active while any upstream is healthy.
+// Failover proxies also move to another upstream here.
+func (pm *ProxyManager) reportUpstream(rp *runningProxy, u *upstream, err error) {
+	rp.mu.Lock()
+	if rp.stopped {
+		rp.mu.Unlock()
+		return
+	}
+
+	key := rp.cfg.Key()
+	healthy := err == nil
+	changed := u.healthy.Swap(healthy) != healthy
+	if changed && healthy {
+		u.healthySince = time.Now()
+	}
+
+	var from, to *upstream
+	if rp.cfg.Balance == "failover" {
+		if next := rp.nextServing(); next != rp.serving {
+			from, to = rp.upstreams[rp.serving], rp.upstreams[next]
+			rp.serving = next
+		}
+	}
+
+	status := "Waiting"
+	for _, other := range rp.upstreams {
+		if other.healthy.Load() {
+			status = "Active"
+			rp.upOnce = true
+			break
+		}
+	}
+	if status != "Active" && rp.upOnce {
+		status = "Degraded"
+	}
+	rp.mu.Unlock()
+
+	switch {
+	case changed && healthy:
+		slog.Info("Upstream is healthy", "proxy", key, "upstream", u.addr)
+	case changed:
+		slog.Warn("Upstream failed its health check", "proxy", key, "upstream", u.addr, "error", err)
+	}
+
+	if to != nil {
+		pm.mu.Lock()
+		rp.stats.Serving = to.addr
+		pm.mu.Unlock()
+		if to == rp.upstreams[0] {
+			pm.addEvent(false, "Port %s failed back to %s", key, to.addr)
+		} else {
+			pm.addEvent(true, "Port %s failed over from %s to %s", key, from.addr, to.addr)
+		}
+	}
+
+	pm.mu.RLock()
+	previous := rp.stats.Status
+	pm.mu.RUnlock()
+	if previous != status {
+		pm.UpdateStats(key, "status", status)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// closedAddr returns a local TCP address nothing is listening on.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// startBanner accepts connections, writes banner to each and hangs up, and
+// sends the time of every accept on the returned channel if anyone listens.
+func startBanner(t *testing.T, banner string) (string, <-chan time.Time) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	accepted := make(chan time.Time, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			select {
+			case accepted <- time.Now():
+			default:
+			}
+			conn.Write([]byte(banner))
+			conn.Close()
+		}
+	}()
+	return ln.Addr().String(), accepted
+}
+
+func TestHealthProbe(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		case "/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer web.Close()
+	webAddr := strings.TrimPrefix(web.URL, "http://")
+	redis, _ := startBanner(t, "+PONG\r\n")
+	down := closedAddr(t)
+	pm := NewProxyManager()
+	dial := pm.dialer(newTestProxy(pm, ProxyConfig{Port: "80"}))
+
+	tests := []struct {
+		name    string
+		check   HealthCheck
+		addr    string
+		wantErr string // substring of the error, "" for a passing check
+	}{
+		{name: "tcp up", addr: redis},
+		{name: "tcp down", addr: down, wantErr: "connection refused"},
+		{name: "http ok", check: HealthCheck{Type: "http", Path: "/"}, addr: webAddr},
+		{name: "http redirect is an answer", check: HealthCheck{Type: "http", Path: "/moved"}, addr: webAddr},
+		{name: "http error status", check: HealthCheck{Type: "http", Path: "/broken"}, addr: webAddr, wantErr: "GET /broken returned 500"},
+		{name: "http unexpected status", check: HealthCheck{Type: "http", Path: "/", ExpectStatus: 204}, addr: webAddr, wantErr: "GET / returned 200, expected 204"},
+		{name: "expect match", check: HealthCheck{Type: "expect", Expect: "+PONG"}, addr: redis},
+		{name: "expect mismatch", check: HealthCheck{Type: "expect", Expect: "+OK"}, addr: redis, wantErr: `expected "+OK", got "+PONG\r\n"`},
+		{name: "expect down", check: HealthCheck{Type: "expect", Expect: "+OK"}, addr: down, wantErr: "connection refused"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.check.probe(tt.addr, time.Second, dial)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("probe failed: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Errorf("probe passed, want an error containing %q", tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Errorf("probe error = %q, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReportUpstreamTransitions(t *testing.T) {
+	pm := NewProxyManager()
+	rp := newTestProxy(pm, ProxyConfig{Port: "5432"}, "10.0.0.1:5432", "10.0.0.2:5432")
+	a, b := rp.upstreams[0], rp.upstreams[1]
+
+	down := net.ErrClosed
+	steps := []struct {
+		u    *upstream
+		err  error
+		want string
+	}{
+		{u: a, err: down, want: "Waiting"}, // nothing reached yet
+		{u: a, err: nil, want: "Active"},
+		{u: b, err: down, want: "Active"},   // a is still up
+		{u: a, err: down, want: "Degraded"}, // everything lost after being up
+		{u: b, err: nil, want: "Active"},
+	}
+	for i, step := range steps {
+		pm.reportUpstream(rp, step.u, step.err)
+		if got := pm.GetStats()["5432"].Status; got != step.want {
+			t.Fatalf("step %d: status = %q, want %q", i, got, step.want)
+		}
+	}
+	if a.healthy.Load() || !b.healthy.Load() {
+		t.Errorf("healthy = %v, %v, want false, true", a.healthy.Load(), b.healthy.Load())
+	}
+
+	rp.stop()
+	pm.reportUpstream(rp, b, down)
+	if got := pm.GetStats()["5432"].Status; got != "Active" {
+		t.Errorf("status after stop = %q, want it left alone", got)
+	}
+}
+
+func TestMonitorUpstreamBackoff(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for real retry delays")
+	}
+
+	// The upstream accepts but never says the expected word, so every check
+	// fails and the retries back off from upstreamRetryMin up to the interval
+	addr, accepted := startBanner(t, "nope\n")
+	pm := NewProxyManager()
+	cfg := ProxyConfig{
+		Port:   "5432",
+		Health: HealthCheck{Type: "expect", Expect: "ok", Interval: 1500 * time.Millisecond, Timeout: time.Second},
+	}
+	rp := newTestProxy(pm, cfg, addr)
+	go pm.monitorUpstream(rp, rp.upstreams[0])
+	defer rp.stop()
+
+	var checks []time.Time
+	for len(checks) < 3 {
+		select {
+		case at := <-accepted:
+			checks = append(checks, at)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d checks ran", len(checks))
+		}
+	}
+
+	// 1s after the first failure, then doubled to 2s but capped by the
+	// 1.5s interval
+	wants := []time.Duration{upstreamRetryMin, 1500 * time.Millisecond}
+	for i, want := range wants {
+		got := checks[i+1].Sub(checks[i])
+		if got < want-100*time.Millisecond || got > want+400*time.Millisecond {
+			t.Errorf("retry %d came after %v, want about %v", i+1, got, want)
+		}
+	}
+
+	// The third check may still be running
+	s := pm.GetStats()[cfg.Key()]
+	for deadline := time.Now().Add(2 * time.Second); s.HealthFailures < 3 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		s = pm.GetStats()[cfg.Key()]
+	}
+	if s.Status != "Waiting" || s.HealthStatus != "unhealthy" || s.HealthFailures < 3 {
+		t.Errorf("status %q, health %q after %d failures, want Waiting and unhealthy after at least 3",
+			s.Status, s.HealthStatus, s.HealthFailures)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// historyWindow is how far back each proxy's history goes, at one sample per
+// rateInterval.
+const historyWindow = 5 * time.Minute
+
+const historyLength = int(historyWindow / rateInterval)
+
+// History is a proxy's recent throughput and connection counts, oldest
+// sample first.
+type History struct {
+	RateIn  []float64 // bytes per second
+	RateOut []float64
+	Active  []float64 // open connections
+}
+
+func (h *History) add(stats *ProxyStats) {
+	h.RateIn = appendSample(h.RateIn, stats.RateIn)
+	h.RateOut = appendSample(h.RateOut, stats.RateOut)
+	h.Active = appendSample(h.Active, float64(atomic.LoadInt64(&stats.ActiveConnections)))
+}
+
+func appendSample(samples []float64, v float64) []float64 {
+	samples = append(samples, v)
+	if len(samples) > historyLength {
+		samples = samples[len(samples)-historyLength:]
+	}
+	return samples
+}
+
+// GetHistory returns a copy of the history for key.
+func (pm *ProxyManager) GetHistory(key string) History {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	h := pm.history[key]
+	if h == nil {
+		return History{}
+	}
+	return History{
+		RateIn:  append([]float64(nil), h.RateIn...),
+		RateOut: append([]float64(nil), h.RateOut...),
+		Active:  append([]float64(nil), h.Active...),
+	}
+}
+
+// recordHistory adds the current rates and connection counts to every
+// proxy's history and forgets proxies that are gone. The caller holds pm.mu.
+func (pm *ProxyManager) recordHistory() {
+	for key, stats := range pm.stats {
+		h := pm.history[key]
+		if h == nil {
+			h = &History{}
+			pm.history[key] = h
+		}
+		h.add(stats)
+	}
+	for key := range pm.history {
+		if _, ok := pm.stats[key]; !ok {
+			delete(pm.history, key)
+		}
+	}
+}
+
+var sparkBlocks = []rune(" ▁▂▃▄▅▆▇█")
+
+// resample squeezes samples into width points, keeping the peak of each
+// bucket so short bursts stay visible. Fewer samples than width are returned
+// as they are.
+func resample(samples []float64, width int) []float64 {
+	if len(samples) <= width {
+		return samples
+	}
+
+	points := make([]float64, width)
+	for i := range points {
+		for _, v := range samples[i*len(samples)/width : (i+1)*len(samples)/width] {
+			points[i] = max(points[i], v)
+		}
+	}
+	return points
+}
+
+func peak(samples []float64) float64 {
+	var top float64
+	for _, v := range samples {
+		top = max(top, v)
+	}
+	return top
+}
+
+// sparkline draws samples as a single line of block characters, newest on
+// the right and padded on the left while the history is still filling up.
+func sparkline(samples []float64, width int) string {
+	return chart(samples, width, 1)[0]
+}
+
+// chart draws samples as a bar chart height lines tall, scaled to the peak.
+// Any non-zero sample shows at least the lowest block.
+func chart(samples []float64, width, height int) []string {
+	points := resample(samples, width)
+	top := peak(points)
+	levels := height * (len(sparkBlocks) - 1)
+
+	lines := make([]string, height)
+	for row := range lines {
+		var b strings.Builder
+		b.WriteString(strings.Repeat(" ", width-len(points)))
+		for _, v := range points {
+			level := 0
+			if top > 0 {
+				level = int(v / top * float64(levels))
+				if v > 0 && level == 0 {
+					level = 1
+				}
+			}
+			// Rows are drawn top down; the bottom row holds the first blocks
+			level -= (height - 1 - row) * (len(sparkBlocks) - 1)
+			level = min(max(level, 0), len(sparkBlocks)-1)
+			if level == 0 && row == height-1 {
+				b.WriteRune('▁')
+				continue
+			}
+			b.WriteRune(sparkBlocks[level])
+		}
+		lines[row] = b.String()
+	}
+	return lines
+}
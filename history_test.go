@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startEchoServer echoes every connection back until the client closes its
+// side, and returns the server's address.
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// freePort returns a port nothing is listening on.
+func freePort(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// dialRetry connects to addr, waiting for a proxy that is still starting.
+func dialRetry(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("proxy at %s never came up: %v", addr, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// TestSampleWhileConnecting samples rates and history, and reads the stats,
+// while connections open, carry data and close. Run it with -race.
+func TestSampleWhileConnecting(t *testing.T) {
+	upstreamHost, upstreamPort, _ := net.SplitHostPort(startEchoServer(t))
+	pm := NewProxyManager()
+	pm.mode = "forward"
+	cfg := ProxyConfig{Host: upstreamHost, Port: freePort(t), TargetPort: upstreamPort, Protocol: "tcp"}
+	pm.startProxy(cfg)
+	t.Cleanup(func() { pm.stopProxy(cfg.Key(), true) })
+	addr := net.JoinHostPort("127.0.0.1", cfg.Port)
+	dialRetry(t, addr).Close()
+
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		prev := make(map[*ProxyStats]rateSample)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			prev = pm.sample(time.Millisecond, prev)
+			pm.GetStats()
+			pm.GetHistory(cfg.Key())
+			pm.Connections("")
+		}
+	}()
+
+	const clients = 20
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Error(err)
+				return
+			}
+			reply := make([]byte, 4)
+			if _, err := io.ReadFull(conn, reply); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Connections finish once the echo server sees the client's EOF
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := pm.GetStats()[cfg.Key()]
+		if stats.ActiveConnections == 0 && stats.TotalConnections == clients+1 {
+			if stats.BytesIn != 4*clients || stats.BytesOut != 4*clients {
+				t.Errorf("counted %d bytes in and %d out, want %d each", stats.BytesIn, stats.BytesOut, 4*clients)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections still active of %d, want 0 of %d", stats.ActiveConnections, stats.TotalConnections, clients+1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-sampled
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// maxLogs is how many warnings and errors are kept for the dashboard.
+const maxLogs = 500
+
+// LogEntry is a warning or error kept for the dashboard's log pane. Proxy is
+// the key of the proxy it concerns, or empty.
+type LogEntry struct {
+	Time    time.Time
+	Level   slog.Level
+	Proxy   string
+	Message string
+}
+
+var (
+	logLevel  string
+	logFormat string
+	logFile   string
+
+	logFileHandle *os.File
+)
+
+// configureLogging installs the default logger, writing to --log-file if set
+// and to console otherwise. It is called again with io.Discard while the
+// dashboard owns the terminal.
+func configureLogging(console io.Writer) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("invalid --log-level %q: expected debug, info, warn or error", logLevel)
+	}
+
+	out := console
+	if logFile != "" {
+		if logFileHandle == nil {
+			f, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return fmt.Errorf("failed to open log file: %v", err)
+			}
+			logFileHandle = f
+		}
+		out = logFileHandle
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch logFormat {
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("invalid --log-format %q: expected text or json", logFormat)
+	}
+
+	slog.SetDefault(slog.New(&paneHandler{next: handler, pm: pm}))
+	return nil
+}
+
+// fatal prints err and exits. It goes to stderr as is, since config errors
+// span several lines, and to the log file as well when there is one.
+func fatal(err error) {
+	if logFile != "" {
+		slog.Error(err.Error())
+	}
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	os.Exit(1)
+}
+
+// paneHandler passes records on to next and keeps warnings and errors for the
+// dashboard, whatever the configured level.
+type paneHandler struct {
+	next  slog.Handler
+	pm    *ProxyManager
+	attrs []slog.Attr
+}
+
+func (h *paneHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || h.next.Enabled(ctx, level)
+}
+
+func (h *paneHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		h.keep(r)
+	}
+	if !h.next.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *paneHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &paneHandler{
+		next:  h.next.WithAttrs(attrs),
+		pm:    h.pm,
+		attrs: append(append([]slog.Attr(nil), h.attrs...), attrs...),
+	}
+}
+
+// WithGroup isn't used by this program; grouped attributes are kept as if
+// they weren't grouped.
+func (h *paneHandler) WithGroup(name string) slog.Handler {
+	return &paneHandler{next: h.next.WithGroup(name), pm: h.pm, attrs: h.attrs}
+}
+
+// keep renders the record as one line, pulling out the proxy attribute.
+func (h *paneHandler) keep(r slog.Record) {
+	entry := LogEntry{Time: r.Time, Level: r.Level}
+	var b strings.Builder
+	b.WriteString(r.Message)
+	add := func(a slog.Attr) bool {
+		if a.Key == "proxy" {
+			entry.Proxy = a.Value.String()
+			return true
+		}
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(add)
+	entry.Message = b.String()
+
+	h.pm.addLog(entry)
+}
+
+func (pm *ProxyManager) addLog(entry LogEntry) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.logs = append(pm.logs, entry)
+	if len(pm.logs) > maxLogs {
+		pm.logs = pm.logs[len(pm.logs)-maxLogs:]
+	}
+}
+
+// GetLogs returns the kept warnings and errors for the proxy with the given
+// key, or for every proxy if key is empty, oldest first.
+func (pm *ProxyManager) GetLogs(key string) []LogEntry {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	var logs []LogEntry
+	for _, entry := range pm.logs {
+		if key == "" || entry.Proxy == key {
+			logs = append(logs, entry)
+		}
+	}
+	return logs
+}
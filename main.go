@@ -1,18 +1,32 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
 	tea "github.com/charmbracelet/bubbletea"
 )
 
 var (
-	headless bool
-	pm       *ProxyManager
+	headless         bool
+	drainTimeout     time.Duration
+	bindAddr         string
+	authKeyFile      string
+	muxPort          string
+	metricsAddr      string
+	adminAddr        string
+	adminAddrSet     bool // --admin-addr was given rather than defaulted
+	accessLogPath    string
+	accessLogMaxSize int
+	accessLogBackups int
+	pm               *ProxyManager
 )
 
 func main() {
@@ -30,7 +44,13 @@ var rootCmd = &cobra.Command{
 	Long: `A simple TCP proxy tool in Go that supports both forward and reverse proxy modes,
 with automatic configuration file support and a beautiful TUI dashboard.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		// Default behavior: forward mode
+		// Default behavior: forward mode, unless the config file asks for reverse
+		if len(args) == 0 {
+			if config, err := loadProjectConfig(); err == nil && config.Mode == "reverse" {
+				runReverseMode(cmd, args)
+				return
+			}
+		}
 		runForwardMode(cmd, args)
 	},
 }
@@ -55,10 +75,27 @@ Can be used with a config file for automatic setup or with manual arguments.`,
 func init() {
 	// Add persistent flags
 	rootCmd.PersistentFlags().BoolVar(&headless, "headless", false, "Run without TUI dashboard")
+	rootCmd.PersistentFlags().StringVar(&bindAddr, "bind", "", "Listen on this IP, interface (e.g. tailscale0) or CIDR unless the config file sets bind")
+	rootCmd.PersistentFlags().StringVar(&authKeyFile, "auth-key-file", "", "Require (reverse) or send (forward) a handshake with the shared key in this file; defaults to $PROXY_AUTH_KEY")
+	rootCmd.PersistentFlags().StringVar(&tunnelCA, "tunnel-ca", "", "Team CA for the mutual TLS tunnel between forward and reverse instances (see proxy cert)")
+	rootCmd.PersistentFlags().StringVar(&tunnelCert, "tunnel-cert", "", "This machine's certificate for the mutual TLS tunnel")
+	rootCmd.PersistentFlags().StringVar(&tunnelKey, "tunnel-key", "", "Key for --tunnel-cert")
+	rootCmd.PersistentFlags().StringVar(&muxPort, "mux-port", "", "Carry every TCP entry over one multiplexed session on this port: reverse listens on it, forward connects to it on each remote host")
+	rootCmd.PersistentFlags().DurationVar(&drainTimeout, "drain-timeout", 10*time.Second, "How long to wait for open connections to finish on shutdown")
+	rootCmd.PersistentFlags().StringVar(&adminAddr, "admin-addr", defaultAdminSocket(), "Serve the admin API on this Unix socket path or loopback address (empty disables it)")
+	rootCmd.PersistentFlags().StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics on this address (e.g. localhost:9100)")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Log level: debug, info, warn or error")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "Log format: text or json")
+	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "Write logs to this file, which also keeps them in TUI mode")
+	rootCmd.PersistentFlags().StringVar(&accessLogPath, "access-log", "", "Write a JSON line to this file for every closed connection")
+	rootCmd.PersistentFlags().IntVar(&accessLogMaxSize, "access-log-max-size", 100, "Rotate the access log once it reaches this many megabytes (0 never rotates)")
+	rootCmd.PersistentFlags().IntVar(&accessLogBackups, "access-log-backups", 3, "How many rotated access logs to keep")
 	
 	// Add subcommands
 	rootCmd.AddCommand(forwardCmd)
 	rootCmd.AddCommand(reverseCmd)
+	rootCmd.AddCommand(ctlCmd)
+	rootCmd.AddCommand(certCmd)
 	
 	// Add flags to subcommands
 	forwardCmd.Flags().BoolVar(&headless, "headless", false, "Run without TUI dashboard")
@@ -66,19 +103,30 @@ func init() {
 }
 
 func runForwardMode(cmd *cobra.Command, args []string) {
+	setupServer(cmd, "forward")
+	startMetrics()
+	defer startAccessLog()()
+	defer startAdmin()()
+	defer startMuxClient()()
+
 	if len(args) == 0 {
 		// Auto forward mode using config file
+		config, err := loadProjectConfig()
+		if err != nil {
+			fatal(err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
 		if headless {
-			if err := pm.RunConfigForwardMode(); err != nil {
-				log.Fatal(err)
+			if err := pm.RunConfigForwardMode(ctx, config); err != nil {
+				fatal(err)
 			}
 		} else {
-			go func() {
-				if err := pm.RunConfigForwardMode(); err != nil {
-					log.Printf("Error in forward mode: %v", err)
-				}
-			}()
-			runTUIMode(pm)
+			runTUIMode(ctx, pm, func(ctx context.Context) error {
+				return pm.RunConfigForwardMode(ctx, config)
+			})
 		}
 	} else if len(args) == 2 {
 		// Manual forward mode
@@ -86,7 +134,7 @@ func runForwardMode(cmd *cobra.Command, args []string) {
 		localPort := args[1]
 		
 		if err := pm.RunSingleForwardProxy(remoteAddr, localPort); err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	} else {
 		fmt.Fprintf(os.Stderr, "Usage: %s forward [remote:port localPort]\n", os.Args[0])
@@ -99,19 +147,30 @@ func runForwardMode(cmd *cobra.Command, args []string) {
 }
 
 func runReverseMode(cmd *cobra.Command, args []string) {
+	setupServer(cmd, "reverse")
+	startMetrics()
+	defer startAccessLog()()
+	defer startAdmin()()
+	defer startMuxServer()()
+
 	if len(args) == 0 {
 		// Auto reverse mode using config file
+		config, err := loadProjectConfig()
+		if err != nil {
+			fatal(err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
 		if headless {
-			if err := pm.RunConfigReverseMode(); err != nil {
-				log.Fatal(err)
+			if err := pm.RunConfigReverseMode(ctx, config); err != nil {
+				fatal(err)
 			}
 		} else {
-			go func() {
-				if err := pm.RunConfigReverseMode(); err != nil {
-					log.Printf("Error in reverse mode: %v", err)
-				}
-			}()
-			runTUIMode(pm)
+			runTUIMode(ctx, pm, func(ctx context.Context) error {
+				return pm.RunConfigReverseMode(ctx, config)
+			})
 		}
 	} else if len(args) == 2 {
 		// Manual reverse mode
@@ -119,7 +178,7 @@ func runReverseMode(cmd *cobra.Command, args []string) {
 		externalPort := args[1]
 		
 		if err := pm.RunSingleReverseProxy(localPort, externalPort); err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	} else {
 		fmt.Fprintf(os.Stderr, "Usage: %s reverse [localPort externalPort]\n", os.Args[0])
@@ -131,14 +190,135 @@ func runReverseMode(cmd *cobra.Command, args []string) {
 	}
 }
 
-func runTUIMode(pm *ProxyManager) {
-	// Disable logging to prevent interference with TUI
-	log.SetOutput(io.Discard)
+// setupServer sets the mode and applies the flags shared by forward and
+// reverse mode, before the admin API or any listener can start a proxy. It is
+// not a PersistentPreRun so that ctl and cert don't trip over them.
+func setupServer(cmd *cobra.Command, mode string) {
+	pm.mode = mode
+	pm.drainTimeout = drainTimeout
+	pm.bind = bindAddr
+	adminAddrSet = cmd.Flags().Changed("admin-addr")
+	if err := configureLogging(os.Stderr); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := validBind(bindAddr); err != nil {
+		fatal(fmt.Errorf("--bind: %v", err))
+	}
+	key, err := loadAuthKey(authKeyFile)
+	if err != nil {
+		fatal(err)
+	}
+	pm.authKey = key
+	if pm.tunnel, err = loadTunnel(tunnelCA, tunnelCert, tunnelKey); err != nil {
+		fatal(err)
+	}
+	if muxPort != "" {
+		if err := validMuxPort(muxPort); err != nil {
+			fatal(err)
+		}
+		pm.muxPort = muxPort
+	}
+}
+
+// startMetrics serves /metrics when --metrics-addr is set.
+func startMetrics() {
+	if metricsAddr == "" {
+		return
+	}
+	if err := pm.serveMetrics(metricsAddr); err != nil {
+		fatal(err)
+	}
+}
+
+// startAccessLog opens the access log when --access-log is set. The returned
+// func closes it.
+func startAccessLog() func() {
+	if accessLogPath == "" {
+		return func() {}
+	}
+	l, err := openAccessLog(accessLogPath, int64(accessLogMaxSize)<<20, accessLogBackups)
+	if err != nil {
+		fatal(err)
+	}
+	pm.accessLog = l
+	return func() { l.Close() }
+}
+
+// startAdmin serves the admin API unless --admin-addr is empty. The returned
+// func stops it. Failing to open the default socket, say because another
+// instance already has it, only costs `proxy ctl` access to this one.
+func startAdmin() func() {
+	if adminAddr == "" {
+		return func() {}
+	}
+	stop, err := pm.serveAdmin(adminAddr)
+	if err != nil {
+		if adminAddrSet {
+			fatal(err)
+		}
+		slog.Warn(err.Error() + "; pass --admin-addr to use another socket")
+		return func() {}
+	}
+	return stop
+}
+
+// startMuxServer listens on --mux-port in reverse mode, on the --bind address
+// if one is set. An interface or CIDR bind without an address yet is waited
+// for rather than fatal. The returned func stops it.
+func startMuxServer() func() {
+	if muxPort == "" {
+		return func() {}
+	}
+	stop, err := pm.serveMux(bindAddr, muxPort)
+	if err != nil {
+		fatal(err)
+	}
+	return stop
+}
+
+// startMuxClient sets up the sessions forward mode opens to --mux-port on
+// each remote host. The returned func ends them.
+func startMuxClient() func() {
+	if muxPort == "" {
+		return func() {}
+	}
+	pm.muxClient = newMuxClient(pm, muxPort)
+	return pm.muxClient.Close
+}
+
+// runTUIMode shows the dashboard while run serves the proxies. Quitting the
+// dashboard cancels run's context, and the program exits once run returns.
+func runTUIMode(ctx context.Context, pm *ProxyManager, run func(context.Context) error) {
+	// Keep logs off the terminal while the dashboard owns it; warnings and
+	// errors still reach the log pane, and --log-file if set
+	configureLogging(io.Discard)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan struct{})
+	var runErr error
+	go func() {
+		defer close(done)
+		runErr = run(ctx)
+	}()
 	
-	p := tea.NewProgram(initialModel(pm), tea.WithAltScreen())
-	if _, err := p.Run(); err != nil {
-		// Re-enable logging for error output
-		log.SetOutput(os.Stderr)
-		log.Fatal(err)
+	p := tea.NewProgram(initialModel(pm, cancel, done), tea.WithAltScreen())
+	_, err := p.Run()
+
+	// Re-enable logging for error output
+	configureLogging(os.Stderr)
+	if err != nil {
+		fatal(err)
+	}
+
+	select {
+	case <-done:
+		if runErr != nil {
+			fatal(runErr)
+		}
+	default:
+		// Forced quit before the drain finished
 	}
 }
\ No newline at end of file
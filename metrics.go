@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dialBuckets are the upper bounds, in seconds, of the dial latency
+// histogram. They match the Prometheus client defaults.
+var dialBuckets = [...]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into dialBuckets. Counts are per bucket, not
+// cumulative; the exposition adds them up.
+type Histogram struct {
+	Counts [len(dialBuckets)]int64
+	Count  int64
+	Sum    time.Duration
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	h.Count++
+	h.Sum += d
+	for i, bound := range dialBuckets {
+		if d.Seconds() <= bound {
+			h.Counts[i]++
+			return
+		}
+	}
+}
+
+// recordDial adds a dial attempt to the upstream's latency histogram and
+// failure count.
+func (pm *ProxyManager) recordDial(us *UpstreamStats, latency time.Duration, err error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if err != nil {
+		us.DialFailures++
+		return
+	}
+	us.DialLatency.observe(latency)
+}
+
+// serveMetrics exposes the proxy statistics for Prometheus on addr. The
+// listener is bound before returning so a bad address fails at startup.
+func (pm *ProxyManager) serveMetrics(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start metrics listener on %s: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", pm.handleMetrics)
+
+	slog.Info("Serving metrics", "url", fmt.Sprintf("http://%s/metrics", listener.Addr()))
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			slog.Error("Metrics server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+func (pm *ProxyManager) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	stats := pm.GetStats()
+	keys := make([]string, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+	defer mw.w.Flush()
+
+	proxyMetric := func(name, kind, help string, value func(*ProxyStats) float64) {
+		mw.header(name, kind, help)
+		for _, key := range keys {
+			stat := stats[key]
+			mw.sample(name, proxyLabels(stat), value(stat))
+		}
+	}
+	upstreamMetric := func(name, kind, help string, value func(*UpstreamStats) float64) {
+		mw.header(name, kind, help)
+		for _, key := range keys {
+			stat := stats[key]
+			for i := range stat.Upstreams {
+				us := &stat.Upstreams[i]
+				mw.sample(name, upstreamLabels(stat, us), value(us))
+			}
+		}
+	}
+
+	proxyMetric("proxy_up", "gauge", "Whether the proxy is listening and has a healthy upstream.",
+		func(s *ProxyStats) float64 { return boolMetric(s.Status == "Active") })
+	proxyMetric("proxy_connections_active", "gauge", "Connections (or UDP sessions) currently open.",
+		func(s *ProxyStats) float64 { return float64(s.ActiveConnections) })
+	proxyMetric("proxy_connections_total", "counter", "Connections (or UDP sessions) accepted.",
+		func(s *ProxyStats) float64 { return float64(s.TotalConnections) })
+	proxyMetric("proxy_bytes_in_total", "counter", "Bytes relayed from clients to the upstream.",
+		func(s *ProxyStats) float64 { return float64(s.BytesIn) })
+	proxyMetric("proxy_bytes_out_total", "counter", "Bytes relayed from the upstream back to clients.",
+		func(s *ProxyStats) float64 { return float64(s.BytesOut) })
+	proxyMetric("proxy_rejected_total", "counter", "Connections (or UDP datagrams) turned away by the allow and deny lists.",
+		func(s *ProxyStats) float64 { return float64(s.Rejected) })
+	proxyMetric("proxy_tls_handshake_errors_total", "counter", "Failed TLS handshakes with clients of TLS listeners.",
+		func(s *ProxyStats) float64 { return float64(s.TLSErrors) })
+	proxyMetric("proxy_datagrams_total", "counter", "UDP datagrams relayed in both directions.",
+		func(s *ProxyStats) float64 { return float64(s.Datagrams) })
+
+	upstreamMetric("proxy_upstream_connections_active", "gauge", "Connections currently open to the upstream.",
+		func(us *UpstreamStats) float64 { return float64(us.ActiveConnections) })
+	upstreamMetric("proxy_upstream_connections_total", "counter", "Connections made to the upstream, including failed dials.",
+		func(us *UpstreamStats) float64 { return float64(us.TotalConnections) })
+	upstreamMetric("proxy_upstream_dial_failures_total", "counter", "Failed attempts to connect to the upstream.",
+		func(us *UpstreamStats) float64 { return float64(us.DialFailures) })
+	upstreamMetric("proxy_upstream_healthy", "gauge", "Whether the last health check passed; -1 before the first check.",
+		func(us *UpstreamStats) float64 {
+			if us.HealthStatus == "" {
+				return -1
+			}
+			return boolMetric(us.HealthStatus == "healthy")
+		})
+	upstreamMetric("proxy_upstream_health_check_duration_seconds", "gauge", "How long the last health check took.",
+		func(us *UpstreamStats) float64 { return us.HealthLatency.Seconds() })
+	upstreamMetric("proxy_upstream_health_check_failures", "gauge", "Health checks that have failed in a row.",
+		func(us *UpstreamStats) float64 { return float64(us.HealthFailures) })
+
+	name := "proxy_upstream_dial_duration_seconds"
+	mw.header(name, "histogram", "Time taken to connect to the upstream.")
+	for _, key := range keys {
+		stat := stats[key]
+		for i := range stat.Upstreams {
+			us := &stat.Upstreams[i]
+			mw.histogram(name, upstreamLabels(stat, us), &us.DialLatency)
+		}
+	}
+}
+
+func proxyLabels(stat *ProxyStats) []string {
+	return []string{"port", stat.Port, "protocol", stat.Protocol, "description", stat.Description}
+}
+
+func upstreamLabels(stat *ProxyStats, us *UpstreamStats) []string {
+	return append(proxyLabels(stat), "upstream", us.Addr)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// metricsWriter writes the Prometheus text exposition format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (mw *metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value; labels alternate between names and values.
+func (mw *metricsWriter) sample(name string, labels []string, value float64) {
+	mw.w.WriteString(name)
+	if len(labels) > 0 {
+		mw.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				mw.w.WriteByte(',')
+			}
+			fmt.Fprintf(mw.w, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		mw.w.WriteByte('}')
+	}
+	fmt.Fprintf(mw.w, " %g\n", value)
+}
+
+func (mw *metricsWriter) histogram(name string, labels []string, h *Histogram) {
+	var cumulative int64
+	for i, bound := range dialBuckets {
+		cumulative += h.Counts[i]
+		mw.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", fmt.Sprintf("%g", bound)), float64(cumulative))
+	}
+	mw.sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", "+Inf"), float64(h.Count))
+	mw.sample(name+"_sum", labels, h.Sum.Seconds())
+	mw.sample(name+"_count", labels, float64(h.Count))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
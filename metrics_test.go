@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramObserve(t *testing.T) {
+	var h Histogram
+	for _, d := range []time.Duration{
+		500 * time.Microsecond, // first bucket
+		time.Millisecond,       // bounds are inclusive
+		30 * time.Millisecond,
+		time.Minute, // past every bucket, only in +Inf
+	} {
+		h.observe(d)
+	}
+
+	want := [len(dialBuckets)]int64{2, 0, 0, 0, 1}
+	if h.Counts != want {
+		t.Errorf("counts = %v, want %v", h.Counts, want)
+	}
+	if h.Count != 4 || h.Sum != time.Minute+31500*time.Microsecond {
+		t.Errorf("count %d, sum %v, want 4 and 1m0.0315s", h.Count, h.Sum)
+	}
+}
+
+func TestMetricsExposition(t *testing.T) {
+	pm := NewProxyManager()
+	pm.stats["5432"] = &ProxyStats{
+		Port: "5432", Protocol: "tcp", Description: `Postgres "main"` + "\n" + `C:\db`,
+		Status: "Active", ActiveConnections: 2, TotalConnections: 7,
+		Upstreams: []UpstreamStats{
+			{Addr: "10.0.0.1:5432", HealthStatus: "healthy", DialFailures: 1},
+			{Addr: "10.0.0.2:5432"},
+		},
+	}
+	pm.stats["53/udp"] = &ProxyStats{Port: "53", Protocol: "udp", Status: "Starting", Datagrams: 12}
+	pm.stats["5432"].Upstreams[0].DialLatency.observe(20 * time.Millisecond)
+	pm.stats["5432"].Upstreams[0].DialLatency.observe(2 * time.Second)
+
+	rec := httptest.NewRecorder()
+	pm.handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+
+	pg := `port="5432",protocol="tcp",description="Postgres \"main\"\nC:\\db"`
+	dns := `port="53",protocol="udp",description=""`
+	up1 := pg + `,upstream="10.0.0.1:5432"`
+	up2 := pg + `,upstream="10.0.0.2:5432"`
+
+	// Families are written in full, proxies sorted by key ("53/udp" before "5432")
+	wantBlocks := []string{
+		"# HELP proxy_up Whether the proxy is listening and has a healthy upstream.\n" +
+			"# TYPE proxy_up gauge\n" +
+			"proxy_up{" + dns + "} 0\n" +
+			"proxy_up{" + pg + "} 1\n",
+		"# TYPE proxy_connections_total counter\n" +
+			"proxy_connections_total{" + dns + "} 0\n" +
+			"proxy_connections_total{" + pg + "} 7\n",
+		"proxy_datagrams_total{" + dns + "} 12\n",
+		"# TYPE proxy_upstream_healthy gauge\n" +
+			"proxy_upstream_healthy{" + up1 + "} 1\n" +
+			"proxy_upstream_healthy{" + up2 + "} -1\n",
+		"proxy_upstream_dial_failures_total{" + up1 + "} 1\n",
+		"# TYPE proxy_upstream_dial_duration_seconds histogram\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up1 + `,le="0.001"} 0` + "\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up1 + `,le="0.005"} 0` + "\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up1 + `,le="0.01"} 0` + "\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up1 + `,le="0.025"} 1` + "\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up1 + `,le="0.05"} 1` + "\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up1 + `,le="0.1"} 1` + "\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up1 + `,le="0.25"} 1` + "\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up1 + `,le="0.5"} 1` + "\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up1 + `,le="1"} 1` + "\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up1 + `,le="2.5"} 2` + "\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up1 + `,le="5"} 2` + "\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up1 + `,le="10"} 2` + "\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up1 + `,le="+Inf"} 2` + "\n" +
+			"proxy_upstream_dial_duration_seconds_sum{" + up1 + "} 2.02\n" +
+			"proxy_upstream_dial_duration_seconds_count{" + up1 + "} 2\n" +
+			"proxy_upstream_dial_duration_seconds_bucket{" + up2 + `,le="0.001"} 0` + "\n",
+	}
+	for _, block := range wantBlocks {
+		if !strings.Contains(body, block) {
+			t.Errorf("exposition is missing\n%s\ngot\n%s", block, body)
+		}
+	}
+
+	// Every line is a comment or a sample, never a stray newline from a label
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if !strings.HasPrefix(line, "# ") && !strings.HasPrefix(line, "proxy_") {
+			t.Errorf("malformed line %q", line)
+		}
+	}
+}
@@ -0,0 +1,1045 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The mux carries every TCP entry between a forward and a reverse instance
+// over one connection, so only the reverse side's --mux-port has to be
+// reachable. After the tunnel and shared-key handshakes, if configured, both
+// sides exchange muxMagic and then speak in frames:
+//
+//	version (1) | type (1) | stream ID (4) | payload length (4) | payload
+//
+// The forward side opens a stream per client with a frameOpen naming the
+// target port, and the reverse side answers with a frameOpenAck, whose payload
+// is an error message if no proxy serves that port. Each direction of a
+// stream may have muxWindow bytes in flight; the reader hands out more with
+// frameWindow as it consumes them, so one slow stream can't stall the rest.
+const (
+	muxMagic      = "PXM1"
+	muxVersion    = 1
+	muxHeaderSize = 10
+	muxMaxFrame   = 32 << 10
+	muxWindow     = 256 << 10
+
+	// muxPingInterval keeps idle sessions alive through NATs; a session that
+	// hears nothing for muxTimeout is considered dead.
+	muxPingInterval = 15 * time.Second
+	muxTimeout      = 45 * time.Second
+
+	// muxOpenTimeout bounds setting up a session or stream when the entry has
+	// no dial timeout.
+	muxOpenTimeout = 10 * time.Second
+)
+
+const (
+	frameOpen byte = iota
+	frameOpenAck
+	frameData
+	frameWindow
+	frameClose // the sender closed its end of the stream
+	frameReset // the stream is gone; payload is the reason
+	framePing
+	framePong
+)
+
+var errStreamReset = errors.New("mux stream reset by peer")
+
+// muxSession is one multiplexed connection between a forward and a reverse
+// instance.
+type muxSession struct {
+	conn   net.Conn
+	peer   string                                // the other instance's tunnel certificate name, if any
+	accept func(s *muxStream, port string) error // reverse side: routes a new stream
+
+	writeMu sync.Mutex
+
+	controlMu    sync.Mutex
+	control      []muxFrame      // control frames queued by the read loop
+	pongQueued   bool            // a pong is in control; more pings need no extra one
+	resetQueued  map[uint32]bool // streams with a reset in control
+	controlReady chan struct{}
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+	err     error // why the session ended
+	done    chan struct{}
+}
+
+func newMuxSession(conn net.Conn, peer string, accept func(*muxStream, string) error) *muxSession {
+	s := &muxSession{
+		conn:    conn,
+		peer:    peer,
+		accept:  accept,
+		streams: make(map[uint32]*muxStream),
+		nextID:  1,
+		done:    make(chan struct{}),
+
+		resetQueued:  make(map[uint32]bool),
+		controlReady: make(chan struct{}, 1),
+	}
+	go s.readLoop()
+	go s.writeLoop()
+	go s.pingLoop()
+	return s
+}
+
+// muxFrame is a control frame waiting to be written.
+type muxFrame struct {
+	typ     byte
+	id      uint32
+	payload []byte
+}
+
+func (s *muxSession) writeFrame(typ byte, id uint32, payload []byte) error {
+	frame := make([]byte, muxHeaderSize+len(payload))
+	frame[0] = muxVersion
+	frame[1] = typ
+	binary.BigEndian.PutUint32(frame[2:], id)
+	binary.BigEndian.PutUint32(frame[6:], uint32(len(payload)))
+	copy(frame[muxHeaderSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(muxTimeout))
+	if _, err := s.conn.Write(frame); err != nil {
+		s.close(err)
+		return s.closedErr()
+	}
+	return nil
+}
+
+// sendControl queues a control frame for writeLoop and returns right away.
+// The read loop must never wait on a write: if both sides stopped reading
+// while their writes were stuck, neither would get going again. The queue
+// has no fixed size but stays small, since a pong answers any number of
+// pings and one reset per stream is enough.
+func (s *muxSession) sendControl(typ byte, id uint32, payload []byte) {
+	s.controlMu.Lock()
+	switch {
+	case typ == framePong && s.pongQueued, typ == frameReset && s.resetQueued[id]:
+		s.controlMu.Unlock()
+		return
+	case typ == framePong:
+		s.pongQueued = true
+	case typ == frameReset:
+		s.resetQueued[id] = true
+	}
+	s.control = append(s.control, muxFrame{typ, id, payload})
+	s.controlMu.Unlock()
+	notify(s.controlReady)
+}
+
+// writeLoop writes the queued control frames in order.
+func (s *muxSession) writeLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.controlReady:
+		}
+
+		s.controlMu.Lock()
+		frames := s.control
+		s.control = nil
+		s.pongQueued = false
+		clear(s.resetQueued)
+		s.controlMu.Unlock()
+
+		for _, f := range frames {
+			if err := s.writeFrame(f.typ, f.id, f.payload); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *muxSession) readLoop() {
+	header := make([]byte, muxHeaderSize)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(muxTimeout))
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.close(err)
+			return
+		}
+		if header[0] != muxVersion {
+			s.close(fmt.Errorf("unsupported mux version %d", header[0]))
+			return
+		}
+		typ := header[1]
+		id := binary.BigEndian.Uint32(header[2:])
+		size := binary.BigEndian.Uint32(header[6:])
+		if size > muxMaxFrame {
+			s.close(fmt.Errorf("mux frame of %d bytes is too large", size))
+			return
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.close(err)
+			return
+		}
+		if err := s.handle(typ, id, payload); err != nil {
+			s.close(err)
+			return
+		}
+	}
+}
+
+func (s *muxSession) handle(typ byte, id uint32, payload []byte) error {
+	switch typ {
+	case framePing:
+		s.sendControl(framePong, 0, payload)
+		return nil
+	case framePong:
+		return nil
+	case frameOpen:
+		return s.handleOpen(id, string(payload))
+	}
+
+	s.mu.Lock()
+	st := s.streams[id]
+	s.mu.Unlock()
+	if st == nil {
+		// Already gone; tell the sender so its writes fail like on a
+		// closed socket
+		if typ == frameData {
+			s.sendControl(frameReset, id, nil)
+		}
+		return nil
+	}
+
+	switch typ {
+	case frameOpenAck:
+		select {
+		case st.opened <- payload:
+		default:
+		}
+	case frameData:
+		return st.receive(payload)
+	case frameWindow:
+		if len(payload) != 4 {
+			return errors.New("malformed mux window update")
+		}
+		st.addCredit(binary.BigEndian.Uint32(payload))
+	case frameClose:
+		st.remoteClose()
+	case frameReset:
+		err := errStreamReset
+		if len(payload) > 0 {
+			err = fmt.Errorf("%w: %s", errStreamReset, payload)
+		}
+		st.fail(err)
+		s.remove(id)
+	default:
+		return fmt.Errorf("unknown mux frame type %d", typ)
+	}
+	return nil
+}
+
+// handleOpen routes a stream the forward side opened.
+func (s *muxSession) handleOpen(id uint32, port string) error {
+	if s.accept == nil {
+		return errors.New("mux stream opened by the reverse side")
+	}
+	st := newMuxStream(s, id)
+	s.mu.Lock()
+	if s.streams[id] != nil {
+		s.mu.Unlock()
+		return fmt.Errorf("mux stream %d opened twice", id)
+	}
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.accept(st, port); err != nil {
+		s.remove(id)
+		s.sendControl(frameOpenAck, id, []byte(err.Error()))
+		return nil
+	}
+	s.sendControl(frameOpenAck, id, nil)
+	return nil
+}
+
+func (s *muxSession) pingLoop() {
+	ticker := time.NewTicker(muxPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.writeFrame(framePing, 0, nil)
+		}
+	}
+}
+
+// open starts a stream to port on the reverse side.
+func (s *muxSession) open(port string, timeout time.Duration) (*muxStream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.closedErr()
+	}
+	id := s.nextID
+	s.nextID += 2
+	st := newMuxStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.writeFrame(frameOpen, id, []byte(port)); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg := <-st.opened:
+		if len(msg) > 0 {
+			s.remove(id)
+			return nil, fmt.Errorf("%s refused the stream: %s", s.conn.RemoteAddr(), msg)
+		}
+		return st, nil
+	case <-timer.C:
+		s.remove(id)
+		s.sendControl(frameReset, id, []byte("open timed out"))
+		return nil, fmt.Errorf("%s didn't answer the stream within %s", s.conn.RemoteAddr(), timeout)
+	case <-s.done:
+		return nil, s.closedErr()
+	}
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.streams, id)
+}
+
+// close ends the session and fails its streams.
+func (s *muxSession) close(err error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*muxStream)
+	s.mu.Unlock()
+
+	s.conn.Close()
+	close(s.done)
+	for _, st := range streams {
+		st.fail(s.closedErr())
+	}
+}
+
+func (s *muxSession) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *muxSession) closedErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if errors.Is(s.err, net.ErrClosed) {
+		return net.ErrClosed
+	}
+	return fmt.Errorf("mux session with %s ended: %v", s.conn.RemoteAddr(), s.err)
+}
+
+// muxStream is one relayed connection inside a session. It implements
+// net.Conn so it can stand in for a TCP connection on either side.
+type muxStream struct {
+	session *muxSession
+	id      uint32
+	opened  chan []byte // forward side: the open ack's payload
+
+	mu            sync.Mutex
+	buf           []byte // received but not yet read
+	consumed      uint32 // read since the last window update
+	credit        uint32 // bytes we may still send
+	localClosed   bool
+	writeClosed   bool // CloseWrite was called; the peer has our frameClose
+	remoteClosed  bool
+	err           error // set when the stream is reset or the session ends
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readReady     chan struct{}
+	writeReady    chan struct{}
+}
+
+func newMuxStream(s *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		session:    s,
+		id:         id,
+		opened:     make(chan []byte, 1),
+		credit:     muxWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// waitReady blocks until ch is notified or the deadline passes.
+func waitReady(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (st *muxStream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.buf) > 0 {
+			n := copy(b, st.buf)
+			st.buf = st.buf[n:]
+			st.consumed += uint32(n)
+			var update uint32
+			if st.consumed >= muxWindow/2 && !st.remoteClosed {
+				update, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+
+			if update > 0 {
+				st.session.writeFrame(frameWindow, st.id, binary.BigEndian.AppendUint32(nil, update))
+			}
+			return n, nil
+		}
+		switch {
+		case st.localClosed:
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		case st.remoteClosed:
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := waitReady(st.readReady, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.localClosed || st.writeClosed:
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		}
+		if st.credit == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := waitReady(st.writeReady, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(b), int(st.credit), muxMaxFrame)
+		st.credit -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.session.writeFrame(frameData, st.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close closes both directions, like closing a socket: data the peer sends
+// afterwards is answered with a reset.
+func (st *muxStream) Close() error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	st.buf = nil
+	done := st.remoteClosed || st.err != nil
+	sendClose := st.err == nil && !st.writeClosed
+	st.mu.Unlock()
+	notify(st.readReady)
+	notify(st.writeReady)
+
+	if sendClose {
+		st.session.writeFrame(frameClose, st.id, nil)
+	}
+	if done {
+		st.session.remove(st.id)
+	}
+	return nil
+}
+
+// CloseWrite tells the peer we're done sending, so its reads see EOF, while
+// still reading what it sends back.
+func (st *muxStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.localClosed || st.writeClosed {
+		st.mu.Unlock()
+		return net.ErrClosed
+	}
+	if err := st.err; err != nil {
+		st.mu.Unlock()
+		return err
+	}
+	st.writeClosed = true
+	st.mu.Unlock()
+	notify(st.writeReady)
+
+	return st.session.writeFrame(frameClose, st.id, nil)
+}
+
+func (st *muxStream) receive(data []byte) error {
+	st.mu.Lock()
+	if st.localClosed {
+		st.mu.Unlock()
+		st.session.remove(st.id)
+		st.session.sendControl(frameReset, st.id, nil)
+		return nil
+	}
+	if len(st.buf)+len(data) > muxWindow {
+		st.mu.Unlock()
+		return fmt.Errorf("mux stream %d overran its window", st.id)
+	}
+	st.buf = append(st.buf, data...)
+	st.mu.Unlock()
+	notify(st.readReady)
+	return nil
+}
+
+func (st *muxStream) addCredit(n uint32) {
+	st.mu.Lock()
+	st.credit += n
+	st.mu.Unlock()
+	notify(st.writeReady)
+}
+
+func (st *muxStream) remoteClose() {
+	st.mu.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.mu.Unlock()
+	notify(st.readReady)
+
+	if done {
+		st.session.remove(st.id)
+	}
+}
+
+func (st *muxStream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	notify(st.readReady)
+	notify(st.writeReady)
+}
+
+func (st *muxStream) LocalAddr() net.Addr  { return st.session.conn.LocalAddr() }
+func (st *muxStream) RemoteAddr() net.Addr { return st.session.conn.RemoteAddr() }
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readReady)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeReady)
+	return nil
+}
+
+// muxServer is the reverse side: it accepts sessions on --mux-port and hands
+// their streams to the listener of the proxy serving the named port. Like a
+// proxy entry, it waits for an interface or CIDR bind to get an address and
+// moves its listener when the address changes; the ports registered with it
+// stay put meanwhile.
+type muxServer struct {
+	pm   *ProxyManager
+	bind string
+	port string
+	stop chan struct{}
+
+	mu       sync.Mutex
+	listener net.Listener // nil while waiting for the bind address
+	ports    map[string]*muxListener
+	sessions map[*muxSession]bool
+}
+
+// serveMux starts accepting sessions on port at the address bind resolves
+// to. The returned func stops it and ends open sessions.
+func (pm *ProxyManager) serveMux(bind, port string) (func(), error) {
+	srv := &muxServer{
+		pm:       pm,
+		bind:     bind,
+		port:     port,
+		stop:     make(chan struct{}),
+		ports:    make(map[string]*muxListener),
+		sessions: make(map[*muxSession]bool),
+	}
+	addr, err := resolveBind(bind)
+	if err == nil {
+		if err := srv.openListener(addr); err != nil {
+			return nil, err
+		}
+	} else {
+		slog.Warn("Waiting for bind address", "mux", port, "bind", bind, "error", err)
+		addr = ""
+	}
+	pm.muxServer = srv
+	if !isAddrBind(bind) {
+		go srv.watchBind(addr)
+	}
+
+	return func() {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		close(srv.stop)
+		if srv.listener != nil {
+			srv.listener.Close()
+		}
+		for s := range srv.sessions {
+			s.close(net.ErrClosed)
+		}
+	}, nil
+}
+
+// openListener listens on host and accepts sessions there until the
+// listener is closed.
+func (srv *muxServer) openListener(host string) error {
+	addr := net.JoinHostPort(host, srv.port)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to start mux listener on %s: %v", addr, err)
+	}
+	srv.mu.Lock()
+	select {
+	case <-srv.stop:
+		srv.mu.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	default:
+	}
+	srv.listener = listener
+	srv.mu.Unlock()
+	slog.Info("Mux listening", "listen", listener.Addr())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					slog.Error("Mux listener stopped", "error", err)
+				}
+				return
+			}
+			go srv.handshake(conn)
+		}
+	}()
+	return nil
+}
+
+// closeListener stops accepting sessions until the bind resolves again.
+// Sessions already open are left alone; they end on their own if their
+// address went away.
+func (srv *muxServer) closeListener() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.listener != nil {
+		srv.listener.Close()
+		srv.listener = nil
+	}
+}
+
+// watchBind resolves an interface or CIDR bind every bindRetryInterval,
+// opening the listener once it has an address and moving it when the
+// address changes or goes away. addr is where it listens now, if anywhere.
+func (srv *muxServer) watchBind(addr string) {
+	ticker := time.NewTicker(bindRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-srv.stop:
+			return
+		case <-ticker.C:
+		}
+
+		current, err := resolveBind(srv.bind)
+		if err == nil && current == addr {
+			continue
+		}
+		if addr != "" {
+			if err != nil {
+				slog.Warn("Bind address went away, waiting for it to come back", "mux", srv.port, "bind", srv.bind, "error", err)
+			} else {
+				slog.Info("Bind address changed", "mux", srv.port, "bind", srv.bind, "from", addr, "to", current)
+			}
+			srv.closeListener()
+			addr = ""
+		}
+		if err != nil {
+			continue
+		}
+		if err := srv.openListener(current); err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("Mux listener failed, retrying", "error", err)
+			}
+			continue
+		}
+		addr = current
+		srv.pm.addEvent(false, "Mux is listening on %s (%s)", net.JoinHostPort(addr, srv.port), srv.bind)
+	}
+}
+
+// addr is the listener's address, or just the port while waiting for the
+// bind address.
+func (srv *muxServer) addr() net.Addr {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.listener != nil {
+		return srv.listener.Addr()
+	}
+	port, _ := strconv.Atoi(srv.port)
+	return &net.TCPAddr{Port: port}
+}
+
+// handshake sets up a session with a forward instance, running the tunnel
+// and shared-key handshakes first when they are configured.
+func (srv *muxServer) handshake(conn net.Conn) {
+	pm := srv.pm
+	client := conn.RemoteAddr()
+	peer := ""
+	reject := func(err error) {
+		slog.Warn("Rejected mux session", "client", client, "error", err)
+		conn.Close()
+	}
+
+	if pm.tunnel != nil {
+		tlsConn := tls.Server(conn, pm.tunnel.listen)
+		tlsConn.SetDeadline(time.Now().Add(muxOpenTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			reject(err)
+			return
+		}
+		peer = peerName(tlsConn)
+		conn = tlsConn
+	}
+	if pm.authKey != nil {
+		if err := verifyClient(conn, pm.authKey, muxOpenTimeout); err != nil {
+			reject(err)
+			return
+		}
+	}
+	if err := exchangeMuxMagic(conn); err != nil {
+		reject(err)
+		return
+	}
+
+	session := newMuxSession(conn, peer, srv.route)
+	srv.mu.Lock()
+	srv.sessions[session] = true
+	srv.mu.Unlock()
+	slog.Info("Mux session started", "client", client, "peer", peer)
+
+	<-session.done
+	srv.mu.Lock()
+	delete(srv.sessions, session)
+	srv.mu.Unlock()
+	slog.Info("Mux session ended", "client", client, "peer", peer, "error", session.err)
+}
+
+// route hands a new stream to the proxy serving port.
+func (srv *muxServer) route(st *muxStream, port string) error {
+	srv.mu.Lock()
+	l := srv.ports[port]
+	srv.mu.Unlock()
+	if l == nil {
+		return fmt.Errorf("no proxy for port %s", port)
+	}
+
+	go func() {
+		select {
+		case l.conns <- st:
+		case <-l.done:
+			st.Close()
+		}
+	}()
+	return nil
+}
+
+// listen registers port, returning the listener its proxy accepts streams
+// from.
+func (srv *muxServer) listen(port string) (net.Listener, error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.ports[port] != nil {
+		return nil, fmt.Errorf("port %s is already served through the mux", port)
+	}
+	l := &muxListener{server: srv, port: port, conns: make(chan net.Conn), done: make(chan struct{})}
+	srv.ports[port] = l
+	return l, nil
+}
+
+// muxListener is what a reverse proxy accepts from instead of a TCP listener
+// when its port is served through the mux.
+type muxListener struct {
+	server *muxServer
+	port   string
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *muxListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.server.mu.Lock()
+		defer l.server.mu.Unlock()
+		if l.server.ports[l.port] == l {
+			delete(l.server.ports, l.port)
+		}
+	})
+	return nil
+}
+
+func (l *muxListener) Addr() net.Addr { return l.server.addr() }
+
+// muxClient is the forward side: it keeps one session per remote host and
+// opens a stream on it for every upstream connection.
+type muxClient struct {
+	pm   *ProxyManager
+	port string
+
+	mu      sync.Mutex
+	hosts   map[string]*muxHost
+	stopped bool
+}
+
+type muxHost struct {
+	mu      sync.Mutex
+	session *muxSession
+}
+
+func newMuxClient(pm *ProxyManager, port string) *muxClient {
+	return &muxClient{pm: pm, port: port, hosts: make(map[string]*muxHost)}
+}
+
+// dial opens a stream to the port in addr on the session with its host.
+func (c *muxClient) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if timeout == 0 {
+		timeout = muxOpenTimeout
+	}
+	session, err := c.session(host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return session.open(port, timeout)
+}
+
+// session returns the session with host, starting one if there is none.
+func (c *muxClient) session(host string, timeout time.Duration) (*muxSession, error) {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	h := c.hosts[host]
+	if h == nil {
+		h = &muxHost{}
+		c.hosts[host] = h
+	}
+	c.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.session != nil && !h.session.closed() {
+		return h.session, nil
+	}
+	addr := net.JoinHostPort(host, c.port)
+	conn, peer, err := c.pm.dialMux(addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("mux session with %s: %v", addr, err)
+	}
+	session := newMuxSession(conn, peer, nil)
+	h.session = session
+	c.pm.addEvent(false, "Mux session with %s started", addr)
+
+	go func() {
+		<-session.done
+		c.mu.Lock()
+		stopped := c.stopped
+		c.mu.Unlock()
+		if !stopped {
+			c.pm.addEvent(true, "Mux session with %s ended: %v", addr, session.err)
+		}
+	}()
+	return session, nil
+}
+
+// Close ends every session.
+func (c *muxClient) Close() {
+	c.mu.Lock()
+	c.stopped = true
+	hosts := c.hosts
+	c.mu.Unlock()
+
+	for _, h := range hosts {
+		h.mu.Lock()
+		if h.session != nil {
+			h.session.close(net.ErrClosed)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// dialMux connects to a reverse instance's mux port, running the tunnel and
+// shared-key handshakes first when they are configured.
+func (pm *ProxyManager) dialMux(addr string, timeout time.Duration) (net.Conn, string, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	peer := ""
+	if pm.tunnel != nil {
+		tlsConn := tls.Client(conn, pm.tunnel.dial)
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+		peer = peerName(tlsConn)
+		conn = tlsConn
+	}
+	if pm.authKey != nil {
+		if err := authenticate(conn, pm.authKey, timeout); err != nil {
+			conn.Close()
+			return nil, "", err
+		}
+	}
+	if err := exchangeMuxMagic(conn); err != nil {
+		conn.Close()
+		return nil, "", fmt.Errorf("%v, is it a proxy reverse --mux-port?", err)
+	}
+	return conn, peer, nil
+}
+
+// exchangeMuxMagic confirms both ends speak the mux protocol.
+func exchangeMuxMagic(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(muxOpenTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write([]byte(muxMagic)); err != nil {
+		return err
+	}
+	magic := make([]byte, len(muxMagic))
+	if _, err := io.ReadFull(conn, magic); err != nil {
+		return fmt.Errorf("no mux greeting: %v", err)
+	}
+	if string(magic) != muxMagic {
+		return errors.New("no mux greeting")
+	}
+	return nil
+}
+
+// muxes reports whether cfg is carried over the mux. An entry with its own
+// TLS settings for that side, tls on a reverse listener or upstream_tls on a
+// forward one, keeps a connection of its own.
+func (pm *ProxyManager) muxes(cfg ProxyConfig) bool {
+	if pm.muxPort == "" || cfg.Protocol != "tcp" || cfg.NoMux {
+		return false
+	}
+	if pm.mode == "reverse" {
+		return cfg.TLS == nil
+	}
+	return cfg.UpstreamTLS == nil
+}
+
+// validMuxPort checks --mux-port.
+func validMuxPort(port string) error {
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return fmt.Errorf("--mux-port must be a port number, got %q", port)
+	}
+	return nil
+}
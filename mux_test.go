@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// encodeFrame lays out a frame the way writeFrame puts it on the wire.
+func encodeFrame(version, typ byte, id uint32, payload []byte) []byte {
+	frame := []byte{version, typ}
+	frame = binary.BigEndian.AppendUint32(frame, id)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+// readFrame reads one frame from the raw end of a session's pipe.
+func readFrame(t *testing.T, conn net.Conn) (typ byte, id uint32, payload []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, muxHeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	if header[0] != muxVersion {
+		t.Fatalf("frame version %d, want %d", header[0], muxVersion)
+	}
+	payload = make([]byte, binary.BigEndian.Uint32(header[6:]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatalf("reading frame payload: %v", err)
+	}
+	return header[1], binary.BigEndian.Uint32(header[2:]), payload
+}
+
+// acceptPort80 routes streams for port 80 to the returned channel and
+// refuses every other port.
+func acceptPort80() (func(*muxStream, string) error, chan *muxStream) {
+	streams := make(chan *muxStream, 8)
+	return func(st *muxStream, port string) error {
+		if port != "80" {
+			return fmt.Errorf("no proxy for port %s", port)
+		}
+		streams <- st
+		return nil
+	}, streams
+}
+
+func TestMuxFraming(t *testing.T) {
+	// A header announcing more than muxMaxFrame, sent without its payload
+	tooLarge := encodeFrame(muxVersion, frameData, 1, nil)
+	binary.BigEndian.PutUint32(tooLarge[6:], muxMaxFrame+1)
+
+	type reply struct {
+		typ     byte
+		id      uint32
+		payload string
+	}
+	tests := []struct {
+		name    string
+		reverse bool     // the session routes streams like the reverse side
+		send    [][]byte // raw frames from the peer
+		want    []reply  // frames the session answers with
+		wantErr string   // why the session ends, if it does; frames still queued are dropped
+	}{
+		{
+			name: "ping is answered",
+			send: [][]byte{encodeFrame(muxVersion, framePing, 0, []byte("hi"))},
+			want: []reply{{framePong, 0, "hi"}},
+		},
+		{
+			name: "data for an unknown stream is reset",
+			send: [][]byte{encodeFrame(muxVersion, frameData, 7, []byte("x"))},
+			want: []reply{{frameReset, 7, ""}},
+		},
+		{
+			name: "other frames for an unknown stream are ignored",
+			send: [][]byte{
+				encodeFrame(muxVersion, frameClose, 7, nil),
+				encodeFrame(muxVersion, framePing, 0, nil),
+			},
+			want: []reply{{framePong, 0, ""}},
+		},
+		{
+			name:    "open is acknowledged",
+			reverse: true,
+			send:    [][]byte{encodeFrame(muxVersion, frameOpen, 1, []byte("80"))},
+			want:    []reply{{frameOpenAck, 1, ""}},
+		},
+		{
+			name:    "open for an unserved port is refused",
+			reverse: true,
+			send:    [][]byte{encodeFrame(muxVersion, frameOpen, 1, []byte("81"))},
+			want:    []reply{{frameOpenAck, 1, "no proxy for port 81"}},
+		},
+		{
+			name:    "stream opened twice",
+			reverse: true,
+			send: [][]byte{
+				encodeFrame(muxVersion, frameOpen, 1, []byte("80")),
+				encodeFrame(muxVersion, frameOpen, 1, []byte("80")),
+			},
+			wantErr: "mux stream 1 opened twice",
+		},
+		{
+			name:    "stream opened by the reverse side",
+			send:    [][]byte{encodeFrame(muxVersion, frameOpen, 2, []byte("80"))},
+			wantErr: "mux stream opened by the reverse side",
+		},
+		{
+			name:    "malformed window update",
+			reverse: true,
+			send: [][]byte{
+				encodeFrame(muxVersion, frameOpen, 1, []byte("80")),
+				encodeFrame(muxVersion, frameWindow, 1, []byte{1, 2}),
+			},
+			wantErr: "malformed mux window update",
+		},
+		{
+			name:    "window overrun",
+			reverse: true,
+			send: [][]byte{
+				encodeFrame(muxVersion, frameOpen, 1, []byte("80")),
+				encodeFrame(muxVersion, frameData, 1, make([]byte, muxMaxFrame)),
+				encodeFrame(muxVersion, frameData, 1, make([]byte, muxMaxFrame)),
+				encodeFrame(muxVersion, frameData, 1, make([]byte, muxMaxFrame)),
+				encodeFrame(muxVersion, frameData, 1, make([]byte, muxMaxFrame)),
+				encodeFrame(muxVersion, frameData, 1, make([]byte, muxMaxFrame)),
+				encodeFrame(muxVersion, frameData, 1, make([]byte, muxMaxFrame)),
+				encodeFrame(muxVersion, frameData, 1, make([]byte, muxMaxFrame)),
+				encodeFrame(muxVersion, frameData, 1, make([]byte, muxMaxFrame)),
+				encodeFrame(muxVersion, frameData, 1, []byte("x")),
+			},
+			wantErr: "mux stream 1 overran its window",
+		},
+		{
+			name:    "unknown frame type",
+			reverse: true,
+			send: [][]byte{
+				encodeFrame(muxVersion, frameOpen, 1, []byte("80")),
+				encodeFrame(muxVersion, 99, 1, nil),
+			},
+			wantErr: "unknown mux frame type 99",
+		},
+		{
+			name:    "unsupported version",
+			send:    [][]byte{encodeFrame(2, framePing, 0, nil)},
+			wantErr: "unsupported mux version 2",
+		},
+		{
+			name:    "frame too large",
+			send:    [][]byte{tooLarge},
+			wantErr: fmt.Sprintf("mux frame of %d bytes is too large", muxMaxFrame+1),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			var accept func(*muxStream, string) error
+			if tt.reverse {
+				accept, _ = acceptPort80()
+			}
+			s := newMuxSession(conn, "", accept)
+			defer s.close(net.ErrClosed)
+
+			go func() {
+				for _, frame := range tt.send {
+					if _, err := peer.Write(frame); err != nil {
+						return
+					}
+				}
+			}()
+
+			for _, want := range tt.want {
+				typ, id, payload := readFrame(t, peer)
+				if got := (reply{typ, id, string(payload)}); got != want {
+					t.Fatalf("reply = %+v, want %+v", got, want)
+				}
+			}
+
+			if tt.wantErr == "" {
+				if s.closed() {
+					t.Fatalf("session ended: %v", s.err)
+				}
+				return
+			}
+			// Drain whatever else the session writes until it hangs up
+			go io.Copy(io.Discard, peer)
+			select {
+			case <-s.done:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("session still running, want it to end with %q", tt.wantErr)
+			}
+			if got := errString(s.err); got != tt.wantErr {
+				t.Errorf("session ended with %q, want %q", got, tt.wantErr)
+			}
+		})
+	}
+}
+
+// muxPair connects a forward and a reverse session over a pipe. Streams the
+// forward side opens to port 80 arrive on the returned channel.
+func muxPair(t *testing.T) (*muxSession, chan *muxStream) {
+	t.Helper()
+	forwardConn, reverseConn := net.Pipe()
+	accept, streams := acceptPort80()
+	forward := newMuxSession(forwardConn, "", nil)
+	reverse := newMuxSession(reverseConn, "", accept)
+	t.Cleanup(func() {
+		forward.close(net.ErrClosed)
+		reverse.close(net.ErrClosed)
+	})
+	return forward, streams
+}
+
+// openPair opens a stream to port 80 and returns both of its ends.
+func openPair(t *testing.T, forward *muxSession, streams chan *muxStream) (*muxStream, *muxStream) {
+	t.Helper()
+	client, err := forward.open("80", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case server := <-streams:
+		return client, server
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream never reached the reverse side")
+		return nil, nil
+	}
+}
+
+func TestMuxOpenRefused(t *testing.T) {
+	forward, _ := muxPair(t)
+	_, err := forward.open("81", time.Second)
+	if got, want := errString(err), "pipe refused the stream: no proxy for port 81"; got != want {
+		t.Errorf("open = %q, want %q", got, want)
+	}
+}
+
+// TestMuxWindow checks that a writer stops after muxWindow unread bytes and
+// resumes once the reader has consumed half of them.
+func TestMuxWindow(t *testing.T) {
+	forward, streams := muxPair(t)
+	client, server := openPair(t, forward, streams)
+
+	data := make([]byte, 2*muxWindow)
+	client.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := client.Write(data)
+	if n != muxWindow || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write = %d, %v; want %d, %v", n, err, muxWindow, os.ErrDeadlineExceeded)
+	}
+
+	if _, err := io.ReadFull(server, make([]byte, muxWindow/2-1)); err != nil {
+		t.Fatal(err)
+	}
+	client.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := client.Write(data[:1]); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write before a window update = %d, %v; want 0, %v", n, err, os.ErrDeadlineExceeded)
+	}
+
+	if _, err := io.ReadFull(server, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	client.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, err := client.Write(data); n != muxWindow/2 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write after a window update = %d, %v; want %d, %v", n, err, muxWindow/2, os.ErrDeadlineExceeded)
+	}
+}
+
+// TestMuxEcho sends several windows' worth through a stream both ways at
+// once, then half-closes it from each side.
+func TestMuxEcho(t *testing.T) {
+	forward, streams := muxPair(t)
+	client, server := openPair(t, forward, streams)
+
+	go func() {
+		io.Copy(server, server)
+		server.CloseWrite()
+	}()
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*muxWindow/16+3)
+	go func() {
+		client.Write(data)
+		client.CloseWrite()
+	}()
+
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("echoed %d bytes, want the %d sent", len(got), len(data))
+	}
+	if _, err := client.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Write after CloseWrite = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+// TestMuxCloseResetsPeerWrites checks that data sent to a closed stream is
+// answered with a reset, like writing to a closed socket.
+func TestMuxCloseResetsPeerWrites(t *testing.T) {
+	forward, streams := muxPair(t)
+	client, server := openPair(t, forward, streams)
+
+	client.Close()
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read after the peer closed = %v, want EOF", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := server.Write([]byte("x"))
+		if errors.Is(err, errStreamReset) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Write = %v, want %v", err, errStreamReset)
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("writes to a closed stream were never reset")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestMuxSessionEnd checks that streams fail once their session is gone.
+func TestMuxSessionEnd(t *testing.T) {
+	forward, streams := muxPair(t)
+	client, _ := openPair(t, forward, streams)
+
+	forward.conn.Close()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read = %v, want the session's error", err)
+	}
+	if _, err := forward.open("80", time.Second); err == nil {
+		t.Error("open on an ended session succeeded")
+	}
+}
+
+// TestMuxSaturated fills every stream's window from both sides at once while
+// the peers answer a flood of pings and reset the data sent to their closed
+// ends. Neither read loop may stall on the control frames it owes.
+func TestMuxSaturated(t *testing.T) {
+	forward, streams := muxPair(t)
+	var reverse *muxSession
+	var writers []*muxStream
+	for i := range 16 {
+		client, server := openPair(t, forward, streams)
+		reverse = server.session
+		if i%2 == 0 {
+			server.Close()
+			writers = append(writers, client)
+		} else {
+			client.Close()
+			writers = append(writers, server)
+		}
+	}
+
+	var wg sync.WaitGroup
+	chunk := make([]byte, 512)
+	for _, st := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			for sent := 0; sent < muxWindow; sent += len(chunk) {
+				if _, err := st.Write(chunk); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	for _, s := range []*muxSession{forward, reverse} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				if err := s.writeFrame(framePing, 0, nil); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(15 * time.Second):
+		t.Fatal("writers stalled; the sessions deadlocked")
+	}
+
+	client, server := openPair(t, forward, streams)
+	go io.Copy(server, server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(client, make([]byte, 4)); err != nil {
+		t.Fatalf("echo after saturation: %v", err)
+	}
+}
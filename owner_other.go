@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// fileOwner can't tell who owns a file here. The temp dir is per user on
+// Windows, so the admin socket needs no such check.
+func fileOwner(os.FileInfo) (int, bool) {
+	return 0, false
+}
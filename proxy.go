@@ -1,14 +1,16 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"net/netip"
 	"os"
-	"path/filepath"
-	"strconv"
+	"reflect"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -16,33 +18,175 @@ import (
 )
 
 type ProxyConfig struct {
-	Port        string
+	Host        string // remote host for forward mode; empty means the default host
+	Port        string // port the proxy listens on
+	TargetPort  string // port connections are relayed to
+	Protocol    string
 	Description string
+
+	// Only settable from .proxy.yaml/.proxy.toml; zero values mean no limit
+	Bind           string // listen address; empty uses the mode's default
+	DialTimeout    time.Duration
+	IdleTimeout    time.Duration
+	MaxConnections int
+	Tags           []string
+	Health         HealthCheck
+	Upstreams      []Upstream // targets to balance across; empty means Host:TargetPort
+	Balance        string     // "round-robin" (default), "least-connections", "random" or "failover"
+	Failback       string     // failover only: "auto" (default) or "manual"
+	FailbackDelay  time.Duration
+	NoAuth         bool           // skip the shared-key handshake for this entry
+	Allow          []netip.Prefix // clients that may connect; empty allows all
+	Deny           []netip.Prefix // clients turned away, even if allowed
+	TLS            *ListenTLS     // terminate TLS on the listener; nil for plain TCP
+	UpstreamTLS    *UpstreamTLS   // dial upstreams over TLS; nil for plain TCP
+	NoTunnel       bool           // skip the mutual TLS tunnel for this entry
+	NoMux          bool           // keep this entry off the multiplexed session
+}
+
+// Key identifies the proxy in the stats table. TCP entries keep the bare port
+// so the same port can also be proxied over UDP.
+func (c ProxyConfig) Key() string {
+	if c.Protocol == "udp" {
+		return c.Port + "/udp"
+	}
+	return c.Port
 }
 
 type ProxyStats struct {
+	Host              string
 	Port              string
+	TargetPort        string
+	Protocol          string
 	Description       string
+	Tags              []string
 	Status            string
 	ActiveConnections int64
 	TotalConnections  int64
-	BytesTransferred  int64
-	LastActivity      time.Time
+	BytesIn           int64   // from clients to the upstream
+	BytesOut          int64   // from the upstream back to clients
+	RateIn            float64 // bytes per second over the last sample
+	RateOut           float64
+	Datagrams         int64
+	Rejected          int64     // clients turned away by the allow and deny lists
+	TLS               bool      // the listener terminates TLS
+	TLSErrors         int64     // failed TLS handshakes with clients
+	LastActivity      time.Time // filled in from lastActivity by GetStats
 	StartTime         time.Time
 	LocalAddr         string
 	RemoteAddr        string
+
+	// Result of the most recent upstream health check
+	HealthStatus    string // "healthy", "unhealthy" or empty before the first check
+	HealthCheckedAt time.Time
+	HealthLatency   time.Duration
+	HealthFailures  int // consecutive failed checks
+	HealthError     string
+
+	Balance   string
+	Serving   string // failover: the upstream new connections go to
+	Upstreams []UpstreamStats
+
+	lastActivity int64 // unix nanoseconds, updated atomically by every read
+}
+
+// touch records activity on the proxy.
+func (s *ProxyStats) touch() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
 }
 
 type ProxyManager struct {
 	stats   map[string]*ProxyStats
 	mu      sync.RWMutex
 	configs []ProxyConfig
+
+	// Config mode state, kept so proxies can be restarted on reload
+	mode         string // "forward" or "reverse", set before any proxy starts
+	defaultHost  string
+	drainTimeout time.Duration
+	authKey      []byte  // shared key for the handshake; nil disables it
+	tunnel       *tunnel // mutual TLS between forward and reverse; nil disables it
+	muxPort      string  // --mux-port; empty gives every entry its own connections
+	muxServer    *muxServer
+	muxClient    *muxClient
+	bind         string // --bind, for entries without their own bind
+	running      map[string]*runningProxy
+	draining     map[*runningProxy]bool // stopped but still finishing connections
+	events       []Event
+	logs         []LogEntry
+	history      map[string]*History
+	accessLog    *accessLog // nil unless --access-log is set
+	localCA      localCA    // issues certificates for TLS listeners without their own
+
+	// Proxies added at runtime through the admin API, kept across reloads
+	dynamic    map[string]ProxyConfig
+	nextConnID atomic.Uint64
+
+	changes sync.Mutex // serializes starting and stopping proxies
+	closing bool       // set once shutdown has begun, guarded by changes
+	single  bool       // serving one proxy from the command line, guarded by changes
 }
 
+// Event is something worth surfacing in the dashboard, like a config reload.
+type Event struct {
+	Time    time.Time
+	Message string
+	Error   bool
+}
+
+const maxEvents = 50
+
+// rateInterval is how often throughput rates are recomputed.
+const rateInterval = time.Second
+
 func NewProxyManager() *ProxyManager {
-	return &ProxyManager{
-		stats: make(map[string]*ProxyStats),
+	pm := &ProxyManager{
+		stats:        make(map[string]*ProxyStats),
+		running:      make(map[string]*runningProxy),
+		draining:     make(map[*runningProxy]bool),
+		dynamic:      make(map[string]ProxyConfig),
+		history:      make(map[string]*History),
+		drainTimeout: 10 * time.Second,
 	}
+	go pm.sampleRates()
+	return pm
+}
+
+// sampleRates keeps RateIn and RateOut current by comparing the byte counters
+// with the previous sample, and records each sample in the history.
+func (pm *ProxyManager) sampleRates() {
+	prev := make(map[*ProxyStats]rateSample)
+	last := time.Now()
+
+	ticker := time.NewTicker(rateInterval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		prev = pm.sample(now.Sub(last), prev)
+		last = now
+	}
+}
+
+// rateSample is a proxy's byte counters at the previous sample.
+type rateSample struct{ in, out int64 }
+
+// sample updates the rates from the counters' change since prev, elapsed
+// ago, and returns the counters to compare the next sample with.
+func (pm *ProxyManager) sample(elapsed time.Duration, prev map[*ProxyStats]rateSample) map[*ProxyStats]rateSample {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	next := make(map[*ProxyStats]rateSample, len(pm.stats))
+	for _, stats := range pm.stats {
+		cur := rateSample{atomic.LoadInt64(&stats.BytesIn), atomic.LoadInt64(&stats.BytesOut)}
+		if p, ok := prev[stats]; ok {
+			stats.RateIn = float64(cur.in-p.in) / elapsed.Seconds()
+			stats.RateOut = float64(cur.out-p.out) / elapsed.Seconds()
+		}
+		next[stats] = cur
+	}
+	pm.recordHistory()
+	return next
 }
 
 func (pm *ProxyManager) GetStats() map[string]*ProxyStats {
@@ -51,12 +195,55 @@ func (pm *ProxyManager) GetStats() map[string]*ProxyStats {
 	
 	result := make(map[string]*ProxyStats)
 	for k, v := range pm.stats {
-		statsCopy := *v
-		result[k] = &statsCopy
+		result[k] = v.snapshot()
 	}
 	return result
 }
 
+// snapshot copies the stats, reading the counters that connections update
+// atomically with atomic loads. A plain struct copy would race with them, so
+// every field is listed. The caller holds pm.mu.
+func (s *ProxyStats) snapshot() *ProxyStats {
+	c := &ProxyStats{
+		Host:              s.Host,
+		Port:              s.Port,
+		TargetPort:        s.TargetPort,
+		Protocol:          s.Protocol,
+		Description:       s.Description,
+		Tags:              s.Tags,
+		Status:            s.Status,
+		ActiveConnections: atomic.LoadInt64(&s.ActiveConnections),
+		TotalConnections:  atomic.LoadInt64(&s.TotalConnections),
+		BytesIn:           atomic.LoadInt64(&s.BytesIn),
+		BytesOut:          atomic.LoadInt64(&s.BytesOut),
+		RateIn:            s.RateIn,
+		RateOut:           s.RateOut,
+		Datagrams:         atomic.LoadInt64(&s.Datagrams),
+		Rejected:          atomic.LoadInt64(&s.Rejected),
+		TLS:               s.TLS,
+		TLSErrors:         atomic.LoadInt64(&s.TLSErrors),
+		StartTime:         s.StartTime,
+		LocalAddr:         s.LocalAddr,
+		RemoteAddr:        s.RemoteAddr,
+		HealthStatus:      s.HealthStatus,
+		HealthCheckedAt:   s.HealthCheckedAt,
+		HealthLatency:     s.HealthLatency,
+		HealthFailures:    s.HealthFailures,
+		HealthError:       s.HealthError,
+		Balance:           s.Balance,
+		Serving:           s.Serving,
+		Upstreams:         make([]UpstreamStats, len(s.Upstreams)),
+		lastActivity:      atomic.LoadInt64(&s.lastActivity),
+	}
+	if c.lastActivity != 0 {
+		c.LastActivity = time.Unix(0, c.lastActivity)
+	}
+	for i := range s.Upstreams {
+		c.Upstreams[i] = s.Upstreams[i].snapshot()
+	}
+	return c
+}
+
 func (pm *ProxyManager) UpdateStats(port string, field string, value interface{}) {
 	pm.mu.Lock()
 	defer pm.mu.Unlock()
@@ -66,366 +253,911 @@ func (pm *ProxyManager) UpdateStats(port string, field string, value interface{}
 	}
 	
 	switch field {
-	case "active_connections":
-		pm.stats[port].ActiveConnections = value.(int64)
 	case "total_connections":
 		atomic.AddInt64(&pm.stats[port].TotalConnections, value.(int64))
-	case "bytes_transferred":
-		atomic.AddInt64(&pm.stats[port].BytesTransferred, value.(int64))
+	case "rejected":
+		atomic.AddInt64(&pm.stats[port].Rejected, value.(int64))
+	case "tls_errors":
+		atomic.AddInt64(&pm.stats[port].TLSErrors, value.(int64))
 	case "last_activity":
-		pm.stats[port].LastActivity = time.Now()
+		pm.stats[port].touch()
 	case "status":
 		pm.stats[port].Status = value.(string)
 	}
 }
 
-func findConfigFile() string {
-	dir, err := os.Getwd()
+// GetEvents returns recent events, oldest first.
+func (pm *ProxyManager) GetEvents() []Event {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	return append([]Event(nil), pm.events...)
+}
+
+func (pm *ProxyManager) addEvent(isError bool, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if isError {
+		slog.Error(msg)
+	} else {
+		slog.Info(msg)
+	}
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	pm.events = append(pm.events, Event{Time: time.Now(), Message: msg, Error: isError})
+	if len(pm.events) > maxEvents {
+		pm.events = pm.events[len(pm.events)-maxEvents:]
+	}
+}
+
+// runningProxy is the listener and live connections of one started proxy.
+type runningProxy struct {
+	cfg    ProxyConfig
+	stats  *ProxyStats
+	done   chan struct{} // closed once the listener has stopped
+	stopCh chan struct{} // closed when the proxy is asked to stop
+	err    error         // why the listener stopped, if it failed
+
+	tlsConfig    *tls.Config // set before accepting when the listener terminates TLS
+	upstreamTLS  *tls.Config // set before dialing when upstreams are dialed over TLS
+	upstreams    []*upstream
+	nextUpstream uint64 // round-robin position
+	serving      int    // failover: index of the upstream in use, guarded by mu
+
+	mu       sync.Mutex
+	listener io.Closer
+	stopped  bool
+	upOnce   bool // the upstream has been reachable at least once
+	conns    map[*proxyConn]bool
+	connsWG  sync.WaitGroup
+}
+
+// proxyConn is a client connection being relayed, tracked so it can be
+// closed from outside when a drain runs out of time.
+type proxyConn struct {
+	id      uint64
+	client  net.Conn
+	started time.Time
+
+	bytesIn      atomic.Int64 // client to upstream
+	bytesOut     atomic.Int64 // upstream to client
+	lastActivity atomic.Int64 // unix nanoseconds
+
+	mu           sync.Mutex
+	upstream     net.Conn
+	upstreamAddr string
+	closed       bool
+	peer         string // the other instance's tunnel certificate name
+	reason       string // why the connection ended, for the access log
+	err          error
+}
+
+// setUpstream records the upstream side of the connection. If the connection
+// was already closed the upstream is closed too and false is returned.
+func (c *proxyConn) setUpstream(upstream net.Conn, addr string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		upstream.Close()
+		return false
+	}
+	c.upstream = upstream
+	c.upstreamAddr = addr
+	return true
+}
+
+// setClient switches the client side to conn, which wraps it, once TLS has
+// been set up. It returns false if the connection was closed meanwhile.
+func (c *proxyConn) setClient(conn net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return false
+	}
+	c.client = conn
+	return true
+}
+
+func (c *proxyConn) setPeer(peer string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.peer = peer
+}
+
+// setReason records why the connection ended. The first reason given wins,
+// so a connection killed through the admin API isn't logged as failing.
+func (c *proxyConn) setReason(reason string, err error) {
+	if reason == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.reason == "" {
+		c.reason = reason
+		c.err = err
+	}
+}
+
+// closeWith closes the connection, recording reason unless one is known.
+func (c *proxyConn) closeWith(reason string) {
+	c.setReason(reason, nil)
+	c.close()
+}
+
+// halfClose passes on that one direction of the relay reached EOF by shutting
+// the write side of dst, the connection it was copied to, so replies can still
+// flow the other way. After an error, or when dst can't be half-closed, the
+// whole connection is closed so neither side is left waiting.
+func (c *proxyConn) halfClose(dst net.Conn, err error) {
+	if cw, ok := dst.(closeWriter); ok && err == nil && cw.CloseWrite() == nil {
+		return
+	}
+	c.close()
+}
+
+func (c *proxyConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	c.client.Close()
+	if c.upstream != nil {
+		c.upstream.Close()
+	}
+}
+
+func newRunningProxy(cfg ProxyConfig, stats *ProxyStats) *runningProxy {
+	upstreams := make([]*upstream, len(stats.Upstreams))
+	for i := range stats.Upstreams {
+		upstreams[i] = &upstream{
+			addr:    stats.Upstreams[i].Addr,
+			stats:   &stats.Upstreams[i],
+			recheck: make(chan struct{}, 1),
+		}
+	}
+
+	return &runningProxy{
+		cfg:    cfg,
+		stats:  stats,
+		done:   make(chan struct{}),
+		stopCh: make(chan struct{}),
+		conns:  make(map[*proxyConn]bool),
+
+		upstreams: upstreams,
+	}
+}
+
+// track registers an accepted client connection. It must be called from the
+// accept loop, before the listener is reported as stopped.
+func (rp *runningProxy) track(client net.Conn, id uint64) *proxyConn {
+	conn := &proxyConn{id: id, client: client, started: time.Now()}
+	conn.lastActivity.Store(conn.started.UnixNano())
+
+	rp.mu.Lock()
+	rp.conns[conn] = true
+	rp.mu.Unlock()
+
+	rp.connsWG.Add(1)
+	return conn
+}
+
+func (rp *runningProxy) untrack(conn *proxyConn) {
+	rp.mu.Lock()
+	delete(rp.conns, conn)
+	rp.mu.Unlock()
+
+	rp.connsWG.Done()
+}
+
+func (rp *runningProxy) connCount() int {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	return len(rp.conns)
+}
+
+// closeConns force-closes every connection still being relayed.
+func (rp *runningProxy) closeConns() {
+	rp.mu.Lock()
+	conns := make([]*proxyConn, 0, len(rp.conns))
+	for conn := range rp.conns {
+		conns = append(conns, conn)
+	}
+	rp.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.closeWith(closeStopped)
+	}
+}
+
+// setListener records the listener so stop can close it. If the proxy was
+// stopped while it was still binding, the listener is closed and false is
+// returned.
+func (rp *runningProxy) setListener(listener io.Closer) bool {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if rp.stopped {
+		listener.Close()
+		return false
+	}
+	rp.listener = listener
+	return true
+}
+
+// stop closes the listener. Connections already accepted keep running.
+func (rp *runningProxy) stop() {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if !rp.stopped {
+		rp.stopped = true
+		close(rp.stopCh)
+	}
+	if rp.listener != nil {
+		rp.listener.Close()
+	}
+}
+
+// reserveConn counts a new connection as active unless max_connections are
+// already, checking and counting in one step so that clients arriving
+// together can't all slip under the limit.
+func (rp *runningProxy) reserveConn() bool {
+	limit := int64(rp.cfg.MaxConnections)
+	for {
+		active := atomic.LoadInt64(&rp.stats.ActiveConnections)
+		if limit > 0 && active >= limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&rp.stats.ActiveConnections, active, active+1) {
+			return true
+		}
+	}
+}
+
+// wait blocks until the listener has stopped and every connection finished.
+func (rp *runningProxy) wait() {
+	<-rp.done
+	rp.connsWG.Wait()
+}
+
+func (pm *ProxyManager) RunSingleReverseProxy(localPort, externalPort string) error {
+	return pm.runSingle(ProxyConfig{
+		Host:        "localhost",
+		Port:        externalPort,
+		TargetPort:  localPort,
+		Protocol:    "tcp",
+		Description: "Manual reverse proxy",
+	})
+}
+
+func (pm *ProxyManager) RunSingleForwardProxy(remoteAddr, localPort string) error {
+	host, port, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
-		return ""
+		return fmt.Errorf("invalid remote address %s: %v", remoteAddr, err)
 	}
 
+	return pm.runSingle(ProxyConfig{
+		Host:        host,
+		Port:        localPort,
+		TargetPort:  port,
+		Protocol:    "tcp",
+		Description: "Manual forward proxy",
+	})
+}
+
+// runSingle serves one proxy given on the command line until its listener
+// fails.
+func (pm *ProxyManager) runSingle(cfg ProxyConfig) error {
+	pm.changes.Lock()
+	pm.single = true
+	pm.changes.Unlock()
+	pm.startProxy(cfg)
+
+	pm.mu.RLock()
+	rp := pm.running[cfg.Key()]
+	pm.mu.RUnlock()
+
 	for {
-		configPath := filepath.Join(dir, ".proxy.conf")
-		if _, err := os.Stat(configPath); err == nil {
-			return configPath
+		<-rp.done
+
+		// A proxy restarted to follow its bind address carries on
+		pm.changes.Lock()
+		pm.mu.RLock()
+		next := pm.running[cfg.Key()]
+		pm.mu.RUnlock()
+		pm.changes.Unlock()
+		if next == nil || next == rp {
+			return rp.err
 		}
+		rp = next
+	}
+}
 
-		parent := filepath.Dir(dir)
-		if parent == dir {
+// RunConfigReverseMode exposes every configured local service until ctx is
+// cancelled, then drains connections and returns.
+func (pm *ProxyManager) RunConfigReverseMode(ctx context.Context, config *Config) error {
+	return pm.runConfig(ctx, config)
+}
+
+// RunConfigForwardMode forwards every configured port until ctx is cancelled,
+// then drains connections and returns.
+func (pm *ProxyManager) RunConfigForwardMode(ctx context.Context, config *Config) error {
+	// Only fall back to PROXY_REMOTE_HOST or the prompt when some entry
+	// doesn't name its own host
+	for _, cfg := range config.Proxies {
+		if cfg.Host == "" {
+			pm.defaultHost = getRemoteHost()
+			if pm.defaultHost == "" {
+				return fmt.Errorf("could not determine remote host")
+			}
 			break
 		}
-		dir = parent
 	}
 
-	return ""
+	return pm.runConfig(ctx, config)
 }
 
-func parseConfigFile(filename string) ([]ProxyConfig, error) {
-	file, err := os.Open(filename)
+// runConfig starts every proxy in config and keeps the running proxies in
+// sync with the config file as it changes, until ctx is cancelled.
+func (pm *ProxyManager) runConfig(ctx context.Context, config *Config) error {
+	configs, err := pm.resolveHosts(config.Proxies)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer file.Close()
 
-	var configs []ProxyConfig
-	scanner := bufio.NewScanner(file)
+	slog.Info("Using config file", "path", config.Path)
+	if pm.mode == "forward" {
+		logHostGroups(configs)
+	}
 
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	pm.applyConfigs(configs)
+	pm.watchConfig(ctx, config.Path)
+
+	slog.Info("Shutting down, draining connections", "timeout", pm.drainTimeout.String())
+	pm.shutdown()
+	return nil
+}
+
+// resolveHosts fills in the host each entry connects to. Reverse mode always
+// targets this machine, so hosts in the config are ignored there.
+func (pm *ProxyManager) resolveHosts(configs []ProxyConfig) ([]ProxyConfig, error) {
+	resolved := make([]ProxyConfig, len(configs))
+	for i, cfg := range configs {
+		switch {
+		case pm.mode == "reverse":
+			cfg.Host = "localhost"
+		case cfg.Host == "" && pm.defaultHost != "":
+			cfg.Host = pm.defaultHost
+		case cfg.Host == "":
+			if pm.defaultHost = os.Getenv("PROXY_REMOTE_HOST"); pm.defaultHost == "" {
+				return nil, fmt.Errorf("port %s has no host and PROXY_REMOTE_HOST is not set", cfg.Key())
+			}
+			cfg.Host = pm.defaultHost
 		}
+		if len(cfg.Upstreams) > 0 && pm.mode != "reverse" {
+			upstreams := make([]Upstream, len(cfg.Upstreams))
+			for j, u := range cfg.Upstreams {
+				if u.Host == "" {
+					u.Host = cfg.Host
+				}
+				upstreams[j] = u
+			}
+			cfg.Upstreams = upstreams
+			cfg.Host = upstreams[0].Host
+		}
+		resolved[i] = cfg
+	}
+	return resolved, nil
+}
+
+func logHostGroups(configs []ProxyConfig) {
+	var hosts []string
+	byHost := make(map[string][]string)
+	for _, cfg := range configs {
+		if _, ok := byHost[cfg.Host]; !ok {
+			hosts = append(hosts, cfg.Host)
+		}
+		byHost[cfg.Host] = append(byHost[cfg.Host], cfg.Key())
+	}
+	for _, host := range hosts {
+		slog.Info("Forwarding from "+host, "ports", strings.Join(byHost[host], ", "))
+	}
+}
 
-		parts := strings.SplitN(line, ":", 2)
-		config := ProxyConfig{
-			Port: parts[0],
+// applyConfigs starts, stops and restarts proxies so the running set matches
+// configs. Proxies whose entry didn't change are left alone, as are proxies
+// added through the admin API unless configs now has an entry for them.
+func (pm *ProxyManager) applyConfigs(configs []ProxyConfig) (added, removed, changed int) {
+	wanted := make(map[string]bool)
+	for _, cfg := range configs {
+		wanted[cfg.Key()] = true
+	}
+
+	pm.changes.Lock()
+	defer pm.changes.Unlock()
+
+	pm.mu.Lock()
+	pm.configs = configs
+	for key := range pm.dynamic {
+		if wanted[key] {
+			delete(pm.dynamic, key)
 		}
-		
-		if len(parts) > 1 {
-			config.Description = parts[1]
+		wanted[key] = true
+	}
+	running := make(map[string]*runningProxy)
+	for key, rp := range pm.running {
+		running[key] = rp
+	}
+	pm.mu.Unlock()
+
+	for key := range running {
+		if !wanted[key] {
+			pm.stopProxy(key, true)
+			removed++
 		}
+	}
 
-		if _, err := strconv.Atoi(config.Port); err != nil {
-			log.Printf("Skipping invalid port: %s", config.Port)
-			continue
+	for _, cfg := range configs {
+		rp, ok := running[cfg.Key()]
+		switch {
+		case !ok:
+			pm.startProxy(cfg)
+			added++
+		case !reflect.DeepEqual(rp.cfg, cfg):
+			pm.stopProxy(cfg.Key(), false)
+			pm.startProxy(cfg)
+			changed++
 		}
+	}
+	return added, removed, changed
+}
 
-		configs = append(configs, config)
+// proxyAddrs returns where cfg listens and where it relays to in the current
+// mode. An interface or CIDR bind is left for startProxy to resolve.
+func (pm *ProxyManager) proxyAddrs(cfg ProxyConfig) (listenAddr, targetAddr string) {
+	bind := cfg.Bind
+	if bind == "" {
+		bind = pm.bind
+	}
+	if pm.mode == "reverse" {
+		if bind == "" {
+			bind = "0.0.0.0"
+		}
+		return net.JoinHostPort(bind, cfg.Port), "localhost:" + cfg.TargetPort
 	}
 
-	return configs, scanner.Err()
+	if bind == "" {
+		bind = "localhost"
+	}
+	return net.JoinHostPort(bind, cfg.Port), net.JoinHostPort(cfg.Host, cfg.TargetPort)
 }
 
-func (pm *ProxyManager) RunSingleReverseProxy(localPort, externalPort string) error {
-	localAddr := "localhost:" + localPort
-	externalAddr := "0.0.0.0:" + externalPort
+// startProxy registers cfg and serves it in the background. Counters survive
+// a restart because the stats entry for the key is reused.
+func (pm *ProxyManager) startProxy(cfg ProxyConfig) {
+	key := cfg.Key()
+	listenAddr, targetAddr := pm.proxyAddrs(cfg)
+	targets := pm.targetAddrs(cfg)
+	if len(targets) > 1 {
+		targetAddr = strings.Join(targets, ", ")
+	}
+
+	desc := cfg.Description
+	if desc == "" {
+		desc = "port " + cfg.Port
+	}
 
 	pm.mu.Lock()
-	pm.stats[localPort] = &ProxyStats{
-		Port:        localPort,
-		Description: "Manual reverse proxy",
-		Status:      "Starting",
-		StartTime:   time.Now(),
-		LocalAddr:   localAddr,
-		RemoteAddr:  externalAddr,
+	stats := pm.stats[key]
+	if stats == nil {
+		stats = &ProxyStats{StartTime: time.Now()}
+		pm.stats[key] = stats
+	}
+	stats.Host = cfg.Host
+	stats.Port = cfg.Port
+	stats.TargetPort = cfg.TargetPort
+	stats.Protocol = cfg.Protocol
+	stats.Description = desc
+	stats.Tags = cfg.Tags
+	stats.TLS = cfg.TLS != nil || (pm.mode == "reverse" && pm.tunnels(cfg))
+	stats.Status = "Starting"
+	stats.HealthStatus = ""
+	stats.HealthFailures = 0
+	stats.HealthError = ""
+	stats.Balance = ""
+	stats.Serving = ""
+	if len(targets) > 1 {
+		stats.Balance = cfg.Balance
+		if stats.Balance == "" {
+			stats.Balance = "round-robin"
+		}
+		if stats.Balance == "failover" {
+			stats.Serving = targets[0]
+		}
 	}
+	// A fresh slice, since connections of a replaced proxy may still be
+	// updating the old one
+	stats.Upstreams = make([]UpstreamStats, len(targets))
+	for i, addr := range targets {
+		stats.Upstreams[i].Addr = addr
+	}
+	// LocalAddr is always this machine's side: the listener in forward mode,
+	// the local service in reverse mode
+	if pm.mode == "reverse" {
+		stats.LocalAddr, stats.RemoteAddr = targetAddr, listenAddr
+	} else {
+		stats.LocalAddr, stats.RemoteAddr = listenAddr, targetAddr
+	}
+
+	rp := newRunningProxy(cfg, stats)
+	pm.running[key] = rp
 	pm.mu.Unlock()
 
-	conn, err := net.Dial("tcp", localAddr)
-	if err != nil {
-		pm.UpdateStats(localPort, "status", "Failed - Local service unavailable")
-		return fmt.Errorf("failed to connect to local service %s: %v", localAddr, err)
-	}
-	conn.Close()
+	go func() {
+		defer close(rp.done)
 
-	listener, err := net.Listen("tcp", externalAddr)
-	if err != nil {
-		pm.UpdateStats(localPort, "status", "Failed - Cannot bind")
-		return fmt.Errorf("failed to start listener on %s: %v", externalAddr, err)
-	}
-	defer listener.Close()
+		// Entries served through the mux have no listener of their own
+		muxed := pm.mode == "reverse" && pm.muxes(cfg)
+		if bind, _, _ := net.SplitHostPort(listenAddr); !muxed && !isAddrBind(bind) {
+			addr, ok := pm.waitForBind(rp, bind)
+			if !ok {
+				return
+			}
+			listenAddr = net.JoinHostPort(addr, cfg.Port)
+			pm.setListenAddr(stats, listenAddr)
+			go pm.watchBind(rp, bind, addr)
+		}
 
-	pm.UpdateStats(localPort, "status", "Active")
-	log.Printf("Reverse TCP proxy started: %s -> %s", externalAddr, localAddr)
+		if cfg.Protocol == "udp" {
+			slog.Info(modeTitle(pm.mode)+" UDP proxy active", "proxy", key, "listen", listenAddr, "target", targetAddr, "description", desc)
+			if err := pm.serveUDP(rp, listenAddr, targetAddr); err != nil {
+				slog.Error(modeTitle(pm.mode)+" UDP proxy stopped", "proxy", key, "description", desc, "error", err)
+			}
+			return
+		}
 
-	for {
-		clientConn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Failed to accept connection on %s: %v", externalAddr, err)
-			continue
+		if rp.err = pm.serveTCP(rp, listenAddr, targetAddr, desc); rp.err != nil {
+			slog.Error(rp.err.Error(), "proxy", key, "description", desc)
 		}
+	}()
+}
 
-		go pm.handleConnection(clientConn, localAddr, localPort)
+// setListenAddr shows the address an interface or CIDR bind resolved to.
+func (pm *ProxyManager) setListenAddr(stats *ProxyStats, listenAddr string) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.mode == "reverse" {
+		stats.RemoteAddr = listenAddr
+	} else {
+		stats.LocalAddr = listenAddr
 	}
 }
 
-func (pm *ProxyManager) RunSingleForwardProxy(remoteAddr, localPort string) error {
-	localAddr := "localhost:" + localPort
-
+// stopProxy closes the listener for key and lets its connections finish in
+// the background. With remove set the row is marked as draining and dropped
+// once the last connection is gone; otherwise the caller is about to start a
+// replacement that takes over the row.
+func (pm *ProxyManager) stopProxy(key string, remove bool) {
 	pm.mu.Lock()
-	pm.stats[localPort] = &ProxyStats{
-		Port:        localPort,
-		Description: "Manual forward proxy",
-		Status:      "Starting",
-		StartTime:   time.Now(),
-		LocalAddr:   localAddr,
-		RemoteAddr:  remoteAddr,
+	rp := pm.running[key]
+	delete(pm.running, key)
+	if rp != nil {
+		pm.draining[rp] = true
 	}
 	pm.mu.Unlock()
 
-	conn, err := net.Dial("tcp", remoteAddr)
-	if err != nil {
-		pm.UpdateStats(localPort, "status", "Failed - Remote unavailable")
-		return fmt.Errorf("failed to connect to remote server %s: %v", remoteAddr, err)
+	if rp == nil {
+		return
 	}
-	conn.Close()
+	rp.stop()
 
-	listener, err := net.Listen("tcp", localAddr)
-	if err != nil {
-		pm.UpdateStats(localPort, "status", "Failed - Cannot bind")
-		return fmt.Errorf("failed to start listener on %s: %v", localAddr, err)
+	if remove {
+		pm.UpdateStats(key, "status", "Draining")
 	}
-	defer listener.Close()
 
-	pm.UpdateStats(localPort, "status", "Active")
-	log.Printf("Forward TCP proxy started: %s -> %s", localAddr, remoteAddr)
+	go func() {
+		rp.wait()
 
-	for {
-		clientConn, err := listener.Accept()
-		if err != nil {
-			log.Printf("Failed to accept connection on %s: %v", localAddr, err)
-			continue
+		pm.mu.Lock()
+		defer pm.mu.Unlock()
+		delete(pm.draining, rp)
+		if _, restarted := pm.running[key]; remove && !restarted && pm.stats[key] == rp.stats {
+			delete(pm.stats, key)
 		}
+	}()
+}
 
-		go pm.handleConnection(clientConn, remoteAddr, localPort)
+// shutdown stops every listener, then waits up to the drain timeout for open
+// connections to finish before force-closing whatever is left.
+func (pm *ProxyManager) shutdown() {
+	pm.changes.Lock()
+	pm.closing = true
+	pm.mu.RLock()
+	keys := make([]string, 0, len(pm.running))
+	for key := range pm.running {
+		keys = append(keys, key)
 	}
-}
+	pm.mu.RUnlock()
 
-func (pm *ProxyManager) RunConfigReverseMode() error {
-	configFile := findConfigFile()
-	if configFile == "" {
-		return fmt.Errorf("no .proxy.conf file found")
+	for _, key := range keys {
+		pm.stopProxy(key, true)
 	}
+	pm.changes.Unlock()
 
-	configs, err := parseConfigFile(configFile)
-	if err != nil {
-		return fmt.Errorf("failed to parse config file %s: %v", configFile, err)
+	pm.mu.RLock()
+	var proxies []*runningProxy
+	for rp := range pm.draining {
+		proxies = append(proxies, rp)
 	}
+	pm.mu.RUnlock()
 
-	if len(configs) == 0 {
-		return fmt.Errorf("no valid port configurations found")
+	activeConns := func() int {
+		total := 0
+		for _, rp := range proxies {
+			total += rp.connCount()
+		}
+		return total
 	}
 
-	pm.configs = configs
-	log.Printf("Using config file: %s", configFile)
+	deadline := time.Now().Add(pm.drainTimeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
 
-	var wg sync.WaitGroup
-	for _, config := range configs {
-		wg.Add(1)
-		go func(cfg ProxyConfig) {
-			defer wg.Done()
-			
-			localAddr := "localhost:" + cfg.Port
-			externalAddr := "0.0.0.0:" + cfg.Port
-			
-			desc := cfg.Description
-			if desc == "" {
-				desc = "port " + cfg.Port
-			}
+	for {
+		active := activeConns()
+		if active == 0 {
+			pm.addEvent(false, "All connections drained, shutting down")
+			break
+		}
 
-			pm.mu.Lock()
-			pm.stats[cfg.Port] = &ProxyStats{
-				Port:        cfg.Port,
-				Description: desc,
-				Status:      "Starting",
-				StartTime:   time.Now(),
-				LocalAddr:   localAddr,
-				RemoteAddr:  externalAddr,
-			}
-			pm.mu.Unlock()
-			
-			conn, err := net.Dial("tcp", localAddr)
-			if err != nil {
-				pm.UpdateStats(cfg.Port, "status", "Failed - Local service unavailable")
-				log.Printf("Failed to connect to local service %s (%s): %v", localAddr, desc, err)
-				return
-			}
-			conn.Close()
-			
-			listener, err := net.Listen("tcp", externalAddr)
-			if err != nil {
-				pm.UpdateStats(cfg.Port, "status", "Failed - Cannot bind")
-				log.Printf("Failed to start listener on %s (%s): %v", externalAddr, desc, err)
-				return
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			pm.addEvent(true, "Drain timeout reached, closing %d remaining connection(s)", active)
+			for _, rp := range proxies {
+				rp.closeConns()
 			}
-			defer listener.Close()
-			
-			pm.UpdateStats(cfg.Port, "status", "Active")
-			log.Printf("Reverse proxy active: %s -> %s (%s)", externalAddr, localAddr, desc)
-			
-			for {
-				clientConn, err := listener.Accept()
-				if err != nil {
-					log.Printf("Failed to accept connection on %s: %v", externalAddr, err)
-					continue
-				}
-				
-				go pm.handleConnection(clientConn, localAddr, cfg.Port)
-			}
-		}(config)
+			break
+		}
+
+		pm.addEvent(false, "Shutting down: waiting for %d connection(s) to finish (%s left)", active, remaining.Round(time.Second))
+		select {
+		case <-ticker.C:
+		case <-time.After(remaining):
+		}
 	}
-	
-	wg.Wait()
-	return nil
-}
 
-func (pm *ProxyManager) RunConfigForwardMode() error {
-	configFile := findConfigFile()
-	if configFile == "" {
-		return fmt.Errorf("no .proxy.conf file found")
+	for _, rp := range proxies {
+		rp.wait()
 	}
+}
 
-	configs, err := parseConfigFile(configFile)
-	if err != nil {
-		return fmt.Errorf("failed to parse config file %s: %v", configFile, err)
+// serveTCP binds listenAddr and relays every accepted connection to one of
+// the proxy's upstreams until the proxy is stopped. The listener comes up
+// whether or not the upstreams are reachable yet; monitorUpstream tracks that
+// separately.
+func (pm *ProxyManager) serveTCP(rp *runningProxy, listenAddr, targetAddr, desc string) error {
+	key := rp.cfg.Key()
+
+	if rp.cfg.TLS != nil {
+		tlsConfig, err := pm.listenTLSConfig(rp.cfg.TLS)
+		if err != nil {
+			pm.UpdateStats(key, "status", "Failed - TLS")
+			return err
+		}
+		rp.tlsConfig = tlsConfig
+	} else if pm.mode == "reverse" && pm.tunnels(rp.cfg) {
+		rp.tlsConfig = pm.tunnel.listen
+	}
+	if rp.cfg.UpstreamTLS != nil {
+		upstreamTLS, err := upstreamTLSConfig(rp.cfg.UpstreamTLS)
+		if err != nil {
+			pm.UpdateStats(key, "status", "Failed - TLS")
+			return err
+		}
+		rp.upstreamTLS = upstreamTLS
+	} else if pm.mode == "forward" && pm.tunnels(rp.cfg) {
+		rp.upstreamTLS = pm.tunnel.dial
 	}
 
-	if len(configs) == 0 {
-		return fmt.Errorf("no valid port configurations found")
+	var listener net.Listener
+	var err error
+	if pm.mode == "reverse" && pm.muxes(rp.cfg) {
+		if listener, err = pm.muxServer.listen(rp.cfg.Port); err != nil {
+			pm.UpdateStats(key, "status", "Failed - Cannot bind")
+			return err
+		}
+		listenAddr = "mux " + listener.Addr().String()
+		pm.setListenAddr(rp.stats, listenAddr)
+	} else if listener, err = net.Listen("tcp", listenAddr); err != nil {
+		pm.UpdateStats(key, "status", "Failed - Cannot bind")
+		return fmt.Errorf("failed to start listener on %s: %v", listenAddr, err)
+	}
+	if !rp.setListener(listener) {
+		return nil
 	}
+	defer listener.Close()
 
-	pm.configs = configs
-	log.Printf("Using config file: %s", configFile)
+	pm.UpdateStats(key, "status", "Waiting")
+	slog.Info(modeTitle(pm.mode)+" proxy listening", "proxy", key, "listen", listenAddr, "target", targetAddr, "description", desc)
 
-	remoteHost := getRemoteHost()
-	if remoteHost == "" {
-		return fmt.Errorf("could not determine remote host")
+	for _, u := range rp.upstreams {
+		go pm.monitorUpstream(rp, u)
 	}
 
-	var wg sync.WaitGroup
-	for _, config := range configs {
-		wg.Add(1)
-		go func(cfg ProxyConfig) {
-			defer wg.Done()
-			
-			remoteAddr := remoteHost + ":" + cfg.Port
-			localAddr := "localhost:" + cfg.Port
-			
-			desc := cfg.Description
-			if desc == "" {
-				desc = "port " + cfg.Port
+	for {
+		clientConn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
 			}
+			slog.Warn("Failed to accept connection", "proxy", key, "error", err)
+			continue
+		}
+		if !rp.cfg.allows(clientConn.RemoteAddr()) {
+			pm.reject(rp, clientConn.RemoteAddr())
+			clientConn.Close()
+			continue
+		}
 
-			pm.mu.Lock()
-			pm.stats[cfg.Port] = &ProxyStats{
-				Port:        cfg.Port,
-				Description: desc,
-				Status:      "Starting",
-				StartTime:   time.Now(),
-				LocalAddr:   localAddr,
-				RemoteAddr:  remoteAddr,
-			}
-			pm.mu.Unlock()
-			
-			conn, err := net.Dial("tcp", remoteAddr)
-			if err != nil {
-				pm.UpdateStats(cfg.Port, "status", "Failed - Remote unavailable")
-				log.Printf("Failed to connect to %s (%s): %v", remoteAddr, desc, err)
-				return
-			}
-			conn.Close()
-			
-			listener, err := net.Listen("tcp", localAddr)
-			if err != nil {
-				pm.UpdateStats(cfg.Port, "status", "Failed - Cannot bind")
-				log.Printf("Failed to start listener on %s (%s): %v", localAddr, desc, err)
-				return
-			}
-			defer listener.Close()
-			
-			pm.UpdateStats(cfg.Port, "status", "Active")
-			log.Printf("Forward proxy active: %s -> %s (%s)", localAddr, remoteAddr, desc)
-			
-			for {
-				clientConn, err := listener.Accept()
-				if err != nil {
-					log.Printf("Failed to accept connection on %s: %v", localAddr, err)
-					continue
-				}
-				
-				go pm.handleConnection(clientConn, remoteAddr, cfg.Port)
-			}
-		}(config)
+		go pm.handleConnection(rp, rp.track(clientConn, pm.nextConnID.Add(1)))
 	}
-	
-	wg.Wait()
-	return nil
 }
 
-func (pm *ProxyManager) handleConnection(clientConn net.Conn, remoteAddr, port string) {
-	defer clientConn.Close()
+func modeTitle(mode string) string {
+	if mode == "reverse" {
+		return "Reverse"
+	}
+	return "Forward"
+}
+
+func (pm *ProxyManager) handleConnection(rp *runningProxy, conn *proxyConn) {
+	defer rp.untrack(conn)
+	defer pm.logConn(rp, conn)
+	defer conn.close()
+
+	if rp.tlsConfig != nil && !pm.terminateTLS(rp, conn) {
+		return
+	}
+	clientConn := conn.client
+	conn.setPeer(peerName(clientConn))
+
+	cfg := rp.cfg
+	port := cfg.Key()
+	if pm.mode == "reverse" && pm.usesAuth(cfg) && !pm.verifyConn(rp, conn) {
+		return
+	}
+	if !rp.reserveConn() {
+		slog.Warn("Rejecting connection: connection limit reached", "proxy", port, "client", clientConn.RemoteAddr(), "limit", cfg.MaxConnections)
+		conn.setReason(closeLimit, nil)
+		return
+	}
+	defer atomic.AddInt64(&rp.stats.ActiveConnections, -1)
 
-	atomic.AddInt64(&pm.stats[port].ActiveConnections, 1)
 	pm.UpdateStats(port, "total_connections", int64(1))
 	pm.UpdateStats(port, "last_activity", nil)
 
-	defer atomic.AddInt64(&pm.stats[port].ActiveConnections, -1)
-
-	remoteConn, err := net.Dial("tcp", remoteAddr)
+	u, remoteConn, err := pm.dialUpstream(rp)
 	if err != nil {
-		log.Printf("Failed to connect to remote server %s: %v", remoteAddr, err)
+		conn.setReason(closeDial, err)
+		return
+	}
+	atomic.AddInt64(&u.stats.ActiveConnections, 1)
+	defer atomic.AddInt64(&u.stats.ActiveConnections, -1)
+
+	if !conn.setUpstream(remoteConn, u.addr) {
 		return
 	}
-	defer remoteConn.Close()
+	if pm.mode == "forward" && (pm.tunnels(cfg) || pm.muxes(cfg)) {
+		conn.setPeer(peerName(remoteConn))
+	}
 
+	if cfg.IdleTimeout > 0 {
+		clientConn = &idleConn{Conn: clientConn, timeout: cfg.IdleTimeout, lastActivity: &conn.lastActivity}
+		remoteConn = &idleConn{Conn: remoteConn, timeout: cfg.IdleTimeout, lastActivity: &conn.lastActivity}
+	}
+
+	// The counters are updated straight from the proxy's stats rather than
+	// through UpdateStats, so reads don't contend for pm.mu
+	stats := rp.stats
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		defer wg.Done()
-		bytes, err := io.Copy(remoteConn, clientConn)
+		_, err := io.Copy(remoteConn, &countingReader{r: clientConn, count: func(n int) {
+			now := time.Now().UnixNano()
+			conn.bytesIn.Add(int64(n))
+			conn.lastActivity.Store(now)
+			atomic.AddInt64(&stats.BytesIn, int64(n))
+			atomic.StoreInt64(&stats.lastActivity, now)
+		}})
 		if err != nil {
-			log.Printf("Error copying client->remote: %v", err)
+			slog.Debug("Error copying client->remote", "proxy", port, "conn", conn.id, "error", err)
 		}
-		pm.UpdateStats(port, "bytes_transferred", bytes)
-		pm.UpdateStats(port, "last_activity", nil)
+		conn.setReason(copyEndReason(closeClient, err))
+		conn.halfClose(remoteConn, err)
 	}()
 
 	go func() {
 		defer wg.Done()
-		bytes, err := io.Copy(clientConn, remoteConn)
+		_, err := io.Copy(clientConn, &countingReader{r: remoteConn, count: func(n int) {
+			now := time.Now().UnixNano()
+			conn.bytesOut.Add(int64(n))
+			conn.lastActivity.Store(now)
+			atomic.AddInt64(&stats.BytesOut, int64(n))
+			atomic.StoreInt64(&stats.lastActivity, now)
+		}})
 		if err != nil {
-			log.Printf("Error copying remote->client: %v", err)
+			slog.Debug("Error copying remote->client", "proxy", port, "conn", conn.id, "error", err)
 		}
-		pm.UpdateStats(port, "bytes_transferred", bytes)
-		pm.UpdateStats(port, "last_activity", nil)
+		conn.setReason(copyEndReason(closeUpstream, err))
+		conn.halfClose(clientConn, err)
 	}()
 
 	wg.Wait()
 }
 
+// countingReader reports every read to count as it happens, so the counters
+// of a long-lived connection stay current instead of jumping when it closes.
+type countingReader struct {
+	r     io.Reader
+	count func(n int)
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if n > 0 {
+		c.count(n)
+	}
+	return n, err
+}
+
+// idleConn closes a connection once neither direction has carried data for
+// timeout. Both halves of a proxied connection share lastActivity, so a
+// one-way stream isn't cut off while the other side is quiet.
+type idleConn struct {
+	net.Conn
+	timeout      time.Duration
+	lastActivity *atomic.Int64
+}
+
+// closeWriter is a connection that can shut its write side on its own, like
+// *net.TCPConn, *tls.Conn and *muxStream.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func (c *idleConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.lastActivity.Store(time.Now().UnixNano())
+		}
+
+		var netErr net.Error
+		if n == 0 && errors.As(err, &netErr) && netErr.Timeout() &&
+			time.Since(time.Unix(0, c.lastActivity.Load())) < c.timeout {
+			continue
+		}
+		return n, err
+	}
+}
+
 func getRemoteHost() string {
 	if host := os.Getenv("PROXY_REMOTE_HOST"); host != "" {
 		return host
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// TestReserveConn has many clients arrive at once and checks that no more
+// than max_connections of them get in.
+func TestReserveConn(t *testing.T) {
+	tests := []struct {
+		limit, clients int
+		want           int64
+	}{
+		{limit: 5, clients: 100, want: 5},
+		{limit: 0, clients: 100, want: 100},
+	}
+
+	for _, tt := range tests {
+		rp := newRunningProxy(ProxyConfig{Port: "8080", MaxConnections: tt.limit}, &ProxyStats{Port: "8080"})
+		var wg sync.WaitGroup
+		var admitted atomic.Int64
+		for range tt.clients {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if rp.reserveConn() {
+					admitted.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if got := admitted.Load(); got != tt.want {
+			t.Errorf("limit %d: admitted %d, want %d", tt.limit, got, tt.want)
+		}
+		if got := atomic.LoadInt64(&rp.stats.ActiveConnections); got != tt.want {
+			t.Errorf("limit %d: %d active, want %d", tt.limit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// configPollInterval is how often the config file is checked for changes.
+const configPollInterval = time.Second
+
+// fileSignature is what watchConfig compares to notice a changed file.
+type fileSignature struct {
+	modTime time.Time
+	size    int64
+	exists  bool
+}
+
+func statConfig(path string) fileSignature {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileSignature{}
+	}
+	return fileSignature{modTime: info.ModTime(), size: info.Size(), exists: true}
+}
+
+// watchConfig polls path and reloads it whenever it changes, until ctx is
+// cancelled. Polling rather than inotify keeps working across platforms and
+// when editors save by replacing the file.
+func (pm *ProxyManager) watchConfig(ctx context.Context, path string) {
+	last := statConfig(path)
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := statConfig(path)
+		if current == last {
+			continue
+		}
+		last = current
+
+		pm.reloadConfig(path)
+	}
+}
+
+// reloadConfig applies the current contents of path. A file that fails to
+// load leaves every running proxy untouched.
+func (pm *ProxyManager) reloadConfig(path string) {
+	name := filepath.Base(path)
+
+	config, err := loadConfig(path)
+	if err != nil {
+		pm.addEvent(true, "Reload of %s failed, keeping current proxies: %v", name, err)
+		return
+	}
+
+	configs, err := pm.resolveHosts(config.Proxies)
+	if err != nil {
+		pm.addEvent(true, "Reload of %s failed, keeping current proxies: %v", name, err)
+		return
+	}
+
+	added, removed, changed := pm.applyConfigs(configs)
+	pm.addEvent(false, "Reloaded %s: %d added, %d removed, %d changed", name, added, removed, changed)
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake with a client.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// closeTLSFailed is the access log reason for clients whose TLS handshake
+// failed.
+const closeTLSFailed = "tls_failed"
+
+// ListenTLS terminates TLS on a proxy's listener. Without Cert and Key a
+// certificate is issued by the auto-generated local CA for Hosts, this
+// machine's name and its addresses.
+type ListenTLS struct {
+	Cert  string
+	Key   string
+	Hosts []string
+}
+
+// listenTLSConfig loads or issues the certificate a listener presents.
+func (pm *ProxyManager) listenTLSConfig(t *ListenTLS) (*tls.Config, error) {
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}
+
+	// The names are worked out when the listener starts, which happens again
+	// on reloads and bind changes. The certificate is issued once up front so
+	// a broken CA fails the listener, then looked up per handshake so it is
+	// renewed before it expires.
+	names, err := pm.localCA.names(t.Hosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue TLS certificate: %v", err)
+	}
+	if _, err := pm.localCA.issue(names); err != nil {
+		return nil, fmt.Errorf("failed to issue TLS certificate: %v", err)
+	}
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := pm.localCA.issue(names)
+			if err != nil {
+				return nil, err
+			}
+			return &cert, nil
+		},
+	}, nil
+}
+
+// terminateTLS runs the TLS handshake with a client of a TLS listener and
+// relays over the TLS connection from then on. Failed handshakes are counted,
+// except for clients that hang up without a word, like TCP health checks.
+func (pm *ProxyManager) terminateTLS(rp *runningProxy, conn *proxyConn) bool {
+	tlsConn := tls.Server(conn.client, rp.tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	switch {
+	case err == nil:
+		return conn.setClient(tlsConn)
+	case err == io.EOF || errors.Is(err, net.ErrClosed):
+		conn.setReason(closeClient, nil)
+	default:
+		key := rp.cfg.Key()
+		conn.setReason(closeTLSFailed, err)
+		pm.UpdateStats(key, "tls_errors", int64(1))
+		slog.Warn("TLS handshake failed", "proxy", key, "client", conn.client.RemoteAddr(), "error", err)
+	}
+	return false
+}
+
+// UpstreamTLS wraps connections to a proxy's upstreams in TLS, for remotes
+// that only accept TLS. ServerName defaults to each upstream's host, CA to the
+// system roots, and Cert and Key are an optional client certificate.
+type UpstreamTLS struct {
+	ServerName         string
+	CA                 string
+	Cert               string
+	Key                string
+	InsecureSkipVerify bool
+}
+
+// upstreamTLSConfig loads the CA bundle and client certificate for dialing
+// upstreams over TLS.
+func upstreamTLSConfig(t *UpstreamTLS) (*tls.Config, error) {
+	config := &tls.Config{ServerName: t.ServerName, InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CA != "" {
+		data, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream CA bundle: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in upstream CA bundle %s", t.CA)
+		}
+	}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load upstream client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// originateTLS runs the TLS handshake on a freshly dialed upstream
+// connection, closing it on failure, and records when the upstream's
+// certificate expires.
+func (pm *ProxyManager) originateTLS(rp *runningProxy, conn net.Conn, addr string, timeout time.Duration) (net.Conn, error) {
+	config := rp.upstreamTLS
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	if timeout == 0 {
+		timeout = tlsHandshakeTimeout
+	}
+
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with %s failed: %v", addr, err)
+	}
+
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		pm.recordCert(rp, addr, certs[0])
+	}
+	return tlsConn, nil
+}
+
+// recordCert keeps the expiry of an upstream's certificate for the detail
+// view.
+func (pm *ProxyManager) recordCert(rp *runningProxy, addr string, cert *x509.Certificate) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, u := range rp.upstreams {
+		if u.addr == addr {
+			u.stats.CertExpiry = cert.NotAfter
+		}
+	}
+}
+
+// localCA is the self-signed CA that issues listener certificates when an
+// entry doesn't bring its own. It is created on first use and kept under the
+// user config dir so teammates only need to trust it once. Since they trust
+// it, its name constraints limit it to this machine and private names and
+// addresses, so a leaked key can't be used to impersonate other sites.
+type localCA struct {
+	mu     sync.Mutex
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	issued map[string]tls.Certificate // by the names they cover
+}
+
+// configDir is where the CA and other generated files are kept.
+func configDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "proxy"), nil
+}
+
+// load reads the CA from disk, creating it the first time.
+func (ca *localCA) load() error {
+	if ca.cert != nil {
+		return nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca-key.pem")
+
+	if _, err := os.Stat(certPath); errors.Is(err, os.ErrNotExist) {
+		if err := createCA(certPath, keyPath, "proxy local CA", constrainLocalCA); err != nil {
+			return err
+		}
+		slog.Info("Created a local CA for TLS listeners; have clients trust it", "cert", certPath)
+	}
+
+	ca.cert, ca.key, err = loadCA(certPath, keyPath)
+	return err
+}
+
+// Private address ranges the local CA may issue for, besides this machine's
+// name and localhost.
+var localCAIPRanges = []string{
+	"127.0.0.0/8", "::1/128", // loopback
+	"100.64.0.0/10", "fd7a:115c:a1e0::/48", // Tailscale
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7", // private networks
+}
+
+// localCADomains are the private DNS suffixes the local CA may issue for:
+// Tailscale's MagicDNS, mDNS and the names reserved for internal use.
+var localCADomains = []string{"localhost", "ts.net", "local", "internal", "lan", "home.arpa"}
+
+// constrainLocalCA limits a new local CA to this machine's hostname and the
+// private names and ranges above.
+func constrainLocalCA(template *x509.Certificate) {
+	template.PermittedDNSDomainsCritical = true
+	template.PermittedDNSDomains = append([]string(nil), localCADomains...)
+	if hostname, err := os.Hostname(); err == nil && net.ParseIP(hostname) == nil {
+		template.PermittedDNSDomains = append(template.PermittedDNSDomains, strings.ToLower(hostname))
+	}
+	for _, cidr := range localCAIPRanges {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		template.PermittedIPRanges = append(template.PermittedIPRanges, ipNet)
+	}
+}
+
+// permits reports whether the CA's name constraints allow it to issue for
+// name. A certificate naming anything else wouldn't verify at all.
+func permits(ca *x509.Certificate, name string) bool {
+	if ip := net.ParseIP(name); ip != nil {
+		if len(ca.PermittedIPRanges) == 0 {
+			return true
+		}
+		for _, ipNet := range ca.PermittedIPRanges {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(ca.PermittedDNSDomains) == 0 {
+		return true
+	}
+	name = strings.ToLower(name)
+	for _, domain := range ca.PermittedDNSDomains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// names lists what a listener certificate for hosts covers: hosts plus this
+// machine's name and addresses, as far as the CA may issue for them.
+func (ca *localCA) names(hosts []string) ([]string, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if err := ca.load(); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range localNames(hosts) {
+		if permits(ca.cert, name) {
+			names = append(names, name)
+		} else if slices.Contains(hosts, name) {
+			slog.Warn("The local CA may not issue for this host; give the entry its own cert and key", "host", name)
+		}
+	}
+	return names, nil
+}
+
+// issue returns a certificate for names, signed by the CA. Certificates are
+// kept until they expire and replaced a day before.
+func (ca *localCA) issue(names []string) (tls.Certificate, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if err := ca.load(); err != nil {
+		return tls.Certificate{}, err
+	}
+
+	id := strings.Join(names, ",")
+	if cert, ok := ca.issued[id]; ok && time.Until(cert.Leaf.NotAfter) > 24*time.Hour {
+		return cert, nil
+	}
+	// Names a listener no longer asks for, after a restart or bind change,
+	// go once their certificate has expired
+	for id, cert := range ca.issued {
+		if time.Now().After(cert.Leaf.NotAfter) {
+			delete(ca.issued, id)
+		}
+	}
+
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: names[0]},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().AddDate(0, 0, 90),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+
+	cert, err := signCert(template, ca.cert, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if ca.issued == nil {
+		ca.issued = make(map[string]tls.Certificate)
+	}
+	ca.issued[id] = cert
+	return cert, nil
+}
+
+// localNames lists the names a listener certificate covers: the extra hosts
+// first, then this machine's hostname, localhost and its addresses.
+func localNames(hosts []string) []string {
+	names := append([]string(nil), hosts...)
+	if hostname, err := os.Hostname(); err == nil {
+		names = append(names, hostname)
+	}
+	names = append(names, "localhost")
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+				names = append(names, ipNet.IP.String())
+			}
+		}
+	}
+
+	var unique []string
+	for _, name := range names {
+		if !slices.Contains(unique, name) {
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
+
+// createCA writes a new self-signed CA certificate and its key. constrain,
+// if not nil, adds name constraints to the CA.
+func createCA(certPath, keyPath, name string, constrain func(*x509.Certificate)) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          randomSerial(),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	if constrain != nil {
+		constrain(template)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	return writeKeyPair(certPath, keyPath, der, key)
+}
+
+func loadCA(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load CA: %v", err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("failed to load CA: %s is not an ECDSA key", keyPath)
+	}
+	return pair.Leaf, key, nil
+}
+
+// signCert issues a certificate for template, with a fresh key, signed by
+// the CA.
+func signCert(template, caCert *x509.Certificate, caKey *ecdsa.PrivateKey) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.SerialNumber = randomSerial()
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// writeKeyPair saves a certificate and its key as PEM, the key readable only
+// by the user.
+func writeKeyPair(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(certPath), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA points the local CA at a fresh config dir and returns a pool that
+// trusts it.
+func testCA(t *testing.T, pm *ProxyManager) *x509.CertPool {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	if err := pm.localCA.load(); err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(pm.localCA.cert)
+	return pool
+}
+
+// tlsHandshake runs a handshake between a server using config and a client
+// trusting roots that asks for serverName.
+func tlsHandshake(config *tls.Config, roots *x509.CertPool, serverName string) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		server := tls.Server(conn, config)
+		server.Handshake()
+		server.Close()
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	client := tls.Client(conn, &tls.Config{RootCAs: roots, ServerName: serverName})
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client.Handshake()
+}
+
+func TestLocalCAListener(t *testing.T) {
+	pm := NewProxyManager()
+	roots := testCA(t, pm)
+
+	dir, _ := configDir()
+	if info, err := os.Stat(filepath.Join(dir, "ca-key.pem")); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0600 {
+		t.Errorf("CA key mode %v, want 0600", info.Mode().Perm())
+	}
+
+	config, err := pm.listenTLSConfig(&ListenTLS{Hosts: []string{"app.internal"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName string
+		wantErr    bool
+	}{
+		{serverName: "app.internal"},
+		{serverName: "localhost"},
+		{serverName: "127.0.0.1"},
+		{serverName: "other.internal", wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tlsHandshake(config, roots, tt.serverName); (err != nil) != tt.wantErr {
+			t.Errorf("handshake for %s: %v, want error %v", tt.serverName, err, tt.wantErr)
+		}
+	}
+
+	// The same names get the same certificate back
+	names, err := pm.localCA.names([]string{"app.internal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := pm.localCA.issue(names)
+	again, _ := pm.localCA.issue(names)
+	if first.Leaf.SerialNumber.Cmp(again.Leaf.SerialNumber) != 0 {
+		t.Error("issue made a new certificate for names it already covers")
+	}
+
+	// Expired certificates for names nobody asks for anymore are dropped
+	expired := first
+	expired.Leaf = &x509.Certificate{NotAfter: time.Now().Add(-time.Minute)}
+	pm.localCA.issued["old.internal"] = expired
+	if _, err := pm.localCA.issue([]string{"new.internal"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pm.localCA.issued["old.internal"]; ok {
+		t.Error("an expired certificate was kept")
+	}
+	if _, ok := pm.localCA.issued[strings.Join(names, ",")]; !ok {
+		t.Error("a current certificate was dropped")
+	}
+}
+
+func TestConfiguredCertListener(t *testing.T) {
+	pm := NewProxyManager()
+	roots := testCA(t, pm)
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cert, err := signCert(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "db.internal"},
+		DNSNames:    []string{"db.internal"},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, pm.localCA.cert, pm.localCA.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeKeyPair(certPath, keyPath, cert.Certificate[0], cert.PrivateKey.(*ecdsa.PrivateKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := pm.listenTLSConfig(&ListenTLS{Cert: certPath, Key: keyPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tlsHandshake(config, roots, "db.internal"); err != nil {
+		t.Errorf("handshake: %v", err)
+	}
+
+	_, err = pm.listenTLSConfig(&ListenTLS{Cert: certPath, Key: filepath.Join(dir, "missing.pem")})
+	if err == nil {
+		t.Error("listenTLSConfig accepted a missing key")
+	}
+}
+
+func TestLocalCAConstraints(t *testing.T) {
+	pm := NewProxyManager()
+	roots := testCA(t, pm)
+	ca := pm.localCA.cert
+	if !ca.PermittedDNSDomainsCritical || len(ca.PermittedIPRanges) == 0 {
+		t.Fatal("local CA has no name constraints")
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "localhost", want: true},
+		{name: "db.internal", want: true},
+		{name: "laptop.tail1234.ts.net", want: true},
+		{name: "printer.LOCAL", want: true},
+		{name: "nas.home.arpa", want: true},
+		{name: "internal", want: true},
+		{name: "example.com"},
+		{name: "example.internal.com"},
+		{name: "127.0.0.1", want: true},
+		{name: "100.101.102.103", want: true},
+		{name: "192.168.1.10", want: true},
+		{name: "fd7a:115c:a1e0::1", want: true},
+		{name: "8.8.8.8"},
+		{name: "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		if got := permits(ca, tt.name); got != tt.want {
+			t.Errorf("permits(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Hosts outside the constraints are left off rather than failing issue
+	names, err := pm.localCA.names([]string{"app.internal", "example.com", "10.1.2.3", "8.8.8.8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := pm.localCA.issue(names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf := cert.Leaf
+	if !slices.Contains(leaf.DNSNames, "app.internal") || slices.Contains(leaf.DNSNames, "example.com") {
+		t.Errorf("DNS names %v, want app.internal without example.com", leaf.DNSNames)
+	}
+	var ips []string
+	for _, ip := range leaf.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	if !slices.Contains(ips, "10.1.2.3") || slices.Contains(ips, "8.8.8.8") {
+		t.Errorf("IP addresses %v, want 10.1.2.3 without 8.8.8.8", ips)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "app.internal"}); err != nil {
+		t.Errorf("issued certificate doesn't verify: %v", err)
+	}
+
+	// Even a certificate signed with the CA's key directly is refused for
+	// names outside the constraints
+	forged, err := signCert(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "example.com"},
+		DNSNames:    []string{"example.com"},
+		NotBefore:   time.Now().Add(-time.Hour),
+		NotAfter:    time.Now().Add(time.Hour),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, pm.localCA.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := forged.Leaf.Verify(x509.VerifyOptions{Roots: roots, DNSName: "example.com"}); err == nil {
+		t.Error("a certificate for example.com verified against the constrained CA")
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log/slog"
+	"net"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/evertras/bubble-table/table"
@@ -12,26 +16,92 @@ import (
 
 type tickMsg time.Time
 
+const (
+	sparklineWidth = 15 // characters in the Last 5m column
+	chartHeight    = 3  // lines per throughput chart in the detail view
+	logPaneHeight  = 8  // lines of the log pane
+)
+
+// shutdownMsg is sent once the proxies have finished shutting down.
+type shutdownMsg struct{}
+
 type model struct {
 	proxyManager *ProxyManager
 	table        table.Model
 	width        int
 	height       int
+
+	shutdown context.CancelFunc // starts a graceful shutdown
+	done     <-chan struct{}    // closed once the shutdown has finished
+	quitting bool
+
+	// detail is the key of the proxy shown in the detail view, if any
+	detail         string
+	upstreamsTable table.Model
+	connsTable     table.Model
+
+	// showLogs shows recent warnings and errors below the table, scrolled
+	// back logScroll lines from the newest
+	showLogs  bool
+	logScroll int
 }
 
-func initialModel(pm *ProxyManager) model {
+func initialModel(pm *ProxyManager, shutdown context.CancelFunc, done <-chan struct{}) model {
 	columns := []table.Column{
-		table.NewColumn("port", "Port", 6),
+		table.NewColumn("port", "Port", 15),
+		table.NewColumn("host", "Host", 16),
 		table.NewColumn("description", "Description", 20),
 		table.NewColumn("status", "Status", 10),
+		table.NewColumn("health", "Health", 9),
 		table.NewColumn("active", "Active", 6),
 		table.NewColumn("total", "Total", 6),
-		table.NewColumn("data", "Data", 8),
+		table.NewColumn("rejected", "Denied", 6),
+		table.NewColumn("in", "In", 8),
+		table.NewColumn("out", "Out", 8),
+		table.NewColumn("rate_in", "In/s", 9),
+		table.NewColumn("rate_out", "Out/s", 9),
+		table.NewColumn("traffic", "Last 5m", sparklineWidth+2),
+		table.NewColumn("datagrams", "Pkts", 6),
 		table.NewColumn("last_activity", "Last Activity", 13),
 	}
 
-	t := table.New(columns).
+	t := styledTable(columns).
 		WithRows([]table.Row{}).
+		Focused(true)
+
+	upstreamColumns := []table.Column{
+		table.NewColumn("addr", "Upstream", 30),
+		table.NewColumn("health", "Health", 9),
+		table.NewColumn("active", "Active", 6),
+		table.NewColumn("total", "Total", 6),
+		table.NewColumn("checked", "Checked", 10),
+		table.NewColumn("cert", "Cert Expires", 12),
+		table.NewColumn("error", "Last Error", 40),
+	}
+
+	connColumns := []table.Column{
+		table.NewColumn("id", "ID", 6),
+		table.NewColumn("client", "Client", 22),
+		table.NewColumn("upstream", "Upstream", 24),
+		table.NewColumn("peer", "Peer", 16),
+		table.NewColumn("age", "Age", 8),
+		table.NewColumn("in", "In", 9),
+		table.NewColumn("out", "Out", 9),
+		table.NewColumn("idle", "Idle", 8),
+	}
+
+	return model{
+		proxyManager:   pm,
+		table:          t,
+		shutdown:       shutdown,
+		done:           done,
+		upstreamsTable: styledTable(upstreamColumns),
+		connsTable:     styledTable(connColumns),
+	}
+}
+
+func styledTable(columns []table.Column) table.Model {
+	return table.New(columns).
 		HeaderStyle(lipgloss.NewStyle().
 			Bold(true).
 			Foreground(lipgloss.Color("15")).
@@ -39,17 +109,18 @@ func initialModel(pm *ProxyManager) model {
 			Padding(0, 1)).
 		WithBaseStyle(lipgloss.NewStyle().
 			BorderForeground(lipgloss.Color("238")).
-			Foreground(lipgloss.Color("252"))).
-		Focused(true)
-
-	return model{
-		proxyManager: pm,
-		table:        t,
-	}
+			Foreground(lipgloss.Color("252")))
 }
 
 func (m model) Init() tea.Cmd {
-	return tickCmd()
+	return tea.Batch(tickCmd(), waitForShutdown(m.done))
+}
+
+func waitForShutdown(done <-chan struct{}) tea.Cmd {
+	return func() tea.Msg {
+		<-done
+		return shutdownMsg{}
+	}
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -60,16 +131,62 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.width = msg.Width
 		m.height = msg.Height
 		m.table = m.table.WithTargetWidth(msg.Width)
+		m.upstreamsTable = m.upstreamsTable.WithTargetWidth(msg.Width)
+		m.connsTable = m.connsTable.WithTargetWidth(msg.Width)
 		return m, nil
 
 	case tea.KeyMsg:
 		switch msg.String() {
 		case "ctrl+c", "q":
-			return m, tea.Quit
+			// The first press drains connections, a second one quits right away
+			if m.quitting {
+				return m, tea.Quit
+			}
+			m.quitting = true
+			m.shutdown()
+			return m, nil
+		case "enter":
+			if key, ok := m.table.HighlightedRow().Data["key"].(string); ok && m.detail == "" {
+				m.detail = key
+				m.upstreamsTable = m.updateUpstreamsData()
+				m.connsTable = m.updateConnsData()
+				m.logScroll = 0
+			}
+			return m, nil
+		case "esc":
+			m.detail = ""
+			m.logScroll = 0
+			return m, nil
+		case "l":
+			m.showLogs = !m.showLogs
+			m.logScroll = 0
+			return m, nil
+		case "pgup":
+			if m.showLogs {
+				older := len(m.proxyManager.GetLogs(m.detail)) - logPaneHeight
+				m.logScroll = max(min(m.logScroll+logPaneHeight, older), 0)
+				return m, nil
+			}
+		case "pgdown":
+			if m.showLogs {
+				m.logScroll = max(m.logScroll-logPaneHeight, 0)
+				return m, nil
+			}
 		}
 
+	case shutdownMsg:
+		return m, tea.Quit
+
 	case tickMsg:
 		m.table = m.updateTableData()
+		if _, ok := m.proxyManager.GetStats()[m.detail]; !ok {
+			// The proxy was removed from the config
+			m.detail = ""
+		}
+		if m.detail != "" {
+			m.upstreamsTable = m.updateUpstreamsData()
+			m.connsTable = m.updateConnsData()
+		}
 		return m, tickCmd()
 	}
 
@@ -109,12 +226,23 @@ func (m model) View() string {
 			Italic(true).
 			MarginTop(2)
 		
-		footer := footerStyle.Render("Press 'q' or Ctrl+C to quit • Updates every 2 seconds")
+		footer := footerStyle.Render(m.footerText())
 		
 		return lipgloss.JoinVertical(lipgloss.Left, header, emptyMsg, footer)
 	}
 	
 	tableView := m.table.View()
+	if stat, ok := stats[m.detail]; ok {
+		tableView = m.detailView(stat)
+	}
+	
+	sections := []string{header, tableView}
+	if m.showLogs {
+		sections = append(sections, m.logPane())
+	}
+	if event := m.lastEvent(); event != "" {
+		sections = append(sections, event)
+	}
 	
 	// Footer
 	footerStyle := lipgloss.NewStyle().
@@ -122,9 +250,180 @@ func (m model) View() string {
 		Italic(true).
 		MarginTop(1)
 	
-	footer := footerStyle.Render("Press 'q' or Ctrl+C to quit • Updates every 2 seconds")
+	footer := footerStyle.Render(m.footerText())
+	sections = append(sections, footer)
 	
-	return lipgloss.JoinVertical(lipgloss.Left, header, tableView, footer)
+	return lipgloss.JoinVertical(lipgloss.Left, sections...)
+}
+
+func (m model) footerText() string {
+	if m.quitting {
+		return "Shutting down, waiting for connections to finish • Press 'q' again to force quit"
+	}
+	logs := "'l' for logs"
+	if m.showLogs {
+		logs = "'l' hides logs, PgUp/PgDn scroll them"
+	}
+	if m.detail != "" {
+		return "Press Esc to go back • " + logs + " • 'q' or Ctrl+C to quit • Updates every 2 seconds"
+	}
+	return "Press Enter for details • " + logs + " • 'q' or Ctrl+C to quit • Updates every 2 seconds"
+}
+
+// logPane shows the recent warnings and errors of the proxy in the detail
+// view, or of every proxy, newest at the bottom.
+func (m model) logPane() string {
+	entries := m.proxyManager.GetLogs(m.detail)
+	title := lipgloss.NewStyle().Bold(true).MarginTop(1)
+	if len(entries) == 0 {
+		return title.Render("No warnings or errors")
+	}
+
+	end := len(entries) - min(m.logScroll, max(len(entries)-logPaneHeight, 0))
+	start := max(end-logPaneHeight, 0)
+
+	line := lipgloss.NewStyle().MaxWidth(m.width)
+	dim := lipgloss.NewStyle().Foreground(lipgloss.Color("241"))
+	lines := []string{title.Render(fmt.Sprintf("Warnings and errors (%d-%d of %d)", start+1, end, len(entries)))}
+	for _, e := range entries[start:end] {
+		level := lipgloss.NewStyle().Foreground(lipgloss.Color("214")).Render("WARN ")
+		if e.Level >= slog.LevelError {
+			level = lipgloss.NewStyle().Foreground(lipgloss.Color("196")).Render("ERROR")
+		}
+		text := dim.Render(e.Time.Format("15:04:05")) + " " + level + " "
+		if m.detail == "" && e.Proxy != "" {
+			text += dim.Render(e.Proxy) + " "
+		}
+		lines = append(lines, line.Render(text+e.Message))
+	}
+	return lipgloss.JoinVertical(lipgloss.Left, lines...)
+}
+
+// detailView shows one proxy with a row per upstream and a row per live
+// connection.
+func (m model) detailView(stat *ProxyStats) string {
+	title := fmt.Sprintf("%s  %s  %s", m.coloredPort(portLabel(stat)), stat.Description, m.coloredStatus(stat.Status))
+	switch {
+	case stat.Balance == "failover":
+		title += "  failover, serving " + stat.Serving
+	case stat.Balance != "":
+		title += "  balancing: " + stat.Balance
+	}
+	if stat.TLS {
+		title += fmt.Sprintf("  TLS, %d handshake error(s)", stat.TLSErrors)
+	}
+
+	style := lipgloss.NewStyle().MarginBottom(1)
+	sections := []string{style.Render(title), m.historyCharts(m.proxyManager.GetHistory(m.detail)), m.upstreamsTable.View()}
+
+	connsTitle := lipgloss.NewStyle().Bold(true).MarginTop(1)
+	switch {
+	case stat.Protocol == "udp":
+		sections = append(sections, connsTitle.Render(fmt.Sprintf("%d UDP session(s)", stat.ActiveConnections)))
+	case m.connsTable.TotalRows() == 0:
+		sections = append(sections, connsTitle.Render("No open connections"))
+	default:
+		sections = append(sections, connsTitle.Render("Connections"), m.connsTable.View())
+	}
+	return lipgloss.JoinVertical(lipgloss.Left, sections...)
+}
+
+// historyCharts draws the last five minutes of throughput in each direction
+// and of open connections.
+func (m model) historyCharts(h History) string {
+	width := min(max(m.width-20, 10), historyLength)
+	label := lipgloss.NewStyle().Width(16).Foreground(lipgloss.Color("241"))
+	in := lipgloss.NewStyle().Foreground(lipgloss.Color("39"))
+	out := lipgloss.NewStyle().Foreground(lipgloss.Color("213"))
+	conns := lipgloss.NewStyle().Foreground(lipgloss.Color("226"))
+
+	draw := func(name string, samples []float64, height int, style lipgloss.Style) string {
+		lines := chart(samples, width, height)
+		return lipgloss.JoinHorizontal(lipgloss.Bottom, label.Render(name), style.Render(strings.Join(lines, "\n")))
+	}
+
+	sections := []string{
+		draw("In  "+formatRate(peak(h.RateIn)), h.RateIn, chartHeight, in),
+		draw("Out "+formatRate(peak(h.RateOut)), h.RateOut, chartHeight, out),
+		draw(fmt.Sprintf("Conns %.0f", peak(h.Active)), h.Active, 2, conns),
+	}
+	caption := lipgloss.NewStyle().Foreground(lipgloss.Color("241")).MarginBottom(1)
+	sections = append(sections, caption.Render(fmt.Sprintf("%16sLast %.0f minutes, scaled to the peak", "", historyWindow.Minutes())))
+	return lipgloss.JoinVertical(lipgloss.Left, sections...)
+}
+
+// coloredSparkline shows the combined throughput of the last five minutes.
+func (m model) coloredSparkline(h History) string {
+	total := make([]float64, len(h.RateIn))
+	for i := range total {
+		total[i] = h.RateIn[i] + h.RateOut[i]
+	}
+	style := lipgloss.NewStyle().Foreground(lipgloss.Color("39"))
+	return style.Render(sparkline(total, sparklineWidth))
+}
+
+func (m model) updateConnsData() table.Model {
+	var rows []table.Row
+	for _, c := range m.proxyManager.Connections(m.detail) {
+		rows = append(rows, table.NewRow(table.RowData{
+			"id":       fmt.Sprintf("%d", c.ID),
+			"client":   c.Client,
+			"upstream": c.Upstream,
+			"peer":     c.Peer,
+			"age":      formatDuration(time.Since(c.Started)),
+			"in":       formatBytes(c.BytesIn),
+			"out":      formatBytes(c.BytesOut),
+			"idle":     formatDuration(time.Since(c.LastActivity)),
+		}))
+	}
+	return m.connsTable.WithRows(rows)
+}
+
+func (m model) updateUpstreamsData() table.Model {
+	stat, ok := m.proxyManager.GetStats()[m.detail]
+	if !ok {
+		return m.upstreamsTable.WithRows(nil)
+	}
+
+	var rows []table.Row
+	for _, us := range stat.Upstreams {
+		checked := "Never"
+		if !us.HealthCheckedAt.IsZero() {
+			checked = formatTime(us.HealthCheckedAt)
+		}
+		addr := us.Addr
+		if stat.Serving == us.Addr {
+			addr = "● " + addr
+		}
+		rows = append(rows, table.NewRow(table.RowData{
+			"addr":    addr,
+			"health":  m.renderHealth(us.HealthStatus, us.HealthLatency, us.HealthFailures),
+			"active":  m.coloredActive(us.ActiveConnections),
+			"total":   fmt.Sprintf("%d", us.TotalConnections),
+			"checked": checked,
+			"cert":    m.renderCertExpiry(us.CertExpiry),
+			"error":   us.HealthError,
+		}))
+	}
+	return m.upstreamsTable.WithRows(rows)
+}
+
+// lastEvent renders the most recent event, such as a config reload, so parse
+// errors are visible without leaving the dashboard.
+func (m model) lastEvent() string {
+	events := m.proxyManager.GetEvents()
+	if len(events) == 0 {
+		return ""
+	}
+	event := events[len(events)-1]
+
+	style := lipgloss.NewStyle().
+		Foreground(lipgloss.Color("46")).
+		MarginTop(1)
+	if event.Error {
+		style = style.Foreground(lipgloss.Color("196"))
+	}
+	return style.Render(event.Time.Format("15:04:05") + " " + event.Message)
 }
 
 func (m model) updateTableData() table.Model {
@@ -133,13 +432,18 @@ func (m model) updateTableData() table.Model {
 	// Sort by activity priority: active connections first, then by last activity
 	type sortableStat struct {
 		*ProxyStats
+		key string
 	}
 	var sortedStats []sortableStat
-	for _, stat := range stats {
-		sortedStats = append(sortedStats, sortableStat{stat})
+	for key, stat := range stats {
+		sortedStats = append(sortedStats, sortableStat{stat, key})
 	}
 	
 	sort.Slice(sortedStats, func(i, j int) bool {
+		// Group rows by upstream host
+		if sortedStats[i].Host != sortedStats[j].Host {
+			return sortedStats[i].Host < sortedStats[j].Host
+		}
 		// Put active connections first, then sort by last activity
 		if sortedStats[i].ActiveConnections > 0 && sortedStats[j].ActiveConnections == 0 {
 			return true
@@ -152,13 +456,23 @@ func (m model) updateTableData() table.Model {
 
 	var rows []table.Row
 	for _, stat := range sortedStats {
+		history := m.proxyManager.GetHistory(stat.key)
 		row := table.NewRow(table.RowData{
-			"port":          m.coloredPort(stat.Port),
+			"key":           stat.key,
+			"port":          m.coloredPort(portLabel(stat.ProxyStats)),
+			"host":          m.servingHost(stat.ProxyStats),
 			"description":   stat.Description,
 			"status":        m.coloredStatus(stat.Status),
+			"health":        m.coloredHealth(stat.ProxyStats),
 			"active":        m.coloredActive(stat.ActiveConnections),
 			"total":         fmt.Sprintf("%d", stat.TotalConnections),
-			"data":          formatBytes(stat.BytesTransferred),
+			"rejected":      m.coloredRejected(stat.Rejected),
+			"in":            formatBytes(stat.BytesIn),
+			"out":           formatBytes(stat.BytesOut),
+			"rate_in":       formatRate(stat.RateIn),
+			"rate_out":      formatRate(stat.RateOut),
+			"traffic":       m.coloredSparkline(history),
+			"datagrams":     formatDatagrams(stat.ProxyStats),
 			"last_activity": formatTime(stat.LastActivity),
 		})
 		rows = append(rows, row)
@@ -174,6 +488,21 @@ func (m model) coloredPort(port string) string {
 	return style.Render(port)
 }
 
+// servingHost is the proxy's upstream host. Failover proxies show the host
+// currently serving, highlighted while it isn't the primary.
+func (m model) servingHost(stat *ProxyStats) string {
+	if stat.Serving == "" || len(stat.Upstreams) == 0 || stat.Serving == stat.Upstreams[0].Addr {
+		return stat.Host
+	}
+
+	host, _, err := net.SplitHostPort(stat.Serving)
+	if err != nil {
+		host = stat.Serving
+	}
+	style := lipgloss.NewStyle().Foreground(lipgloss.Color("208"))
+	return style.Render(host + " ⇣")
+}
+
 func (m model) coloredStatus(status string) string {
 	var style lipgloss.Style
 	switch status {
@@ -181,10 +510,14 @@ func (m model) coloredStatus(status string) string {
 		style = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("46")).
 			Bold(true)
-	case "Starting":
+	case "Starting", "Waiting", "Draining":
 		style = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("226")).
 			Bold(true)
+	case "Degraded":
+		style = lipgloss.NewStyle().
+			Foreground(lipgloss.Color("208")).
+			Bold(true)
 	default:
 		style = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("196")).
@@ -193,6 +526,57 @@ func (m model) coloredStatus(status string) string {
 	return style.Render(status)
 }
 
+// coloredHealth shows the latency of the last passing health check, or the
+// number of checks that have failed in a row. Proxies balancing across
+// several upstreams show how many of them are healthy instead.
+func (m model) coloredHealth(stat *ProxyStats) string {
+	if len(stat.Upstreams) > 1 && stat.HealthStatus == "healthy" {
+		healthy := 0
+		for _, us := range stat.Upstreams {
+			if us.HealthStatus == "healthy" {
+				healthy++
+			}
+		}
+		style := lipgloss.NewStyle().Foreground(lipgloss.Color("46"))
+		if healthy < len(stat.Upstreams) {
+			style = style.Foreground(lipgloss.Color("208"))
+		}
+		return style.Render(fmt.Sprintf("✓ %d/%d", healthy, len(stat.Upstreams)))
+	}
+	return m.renderHealth(stat.HealthStatus, stat.HealthLatency, stat.HealthFailures)
+}
+
+// renderCertExpiry shows how long an upstream's TLS certificate has left,
+// warning from 30 days out.
+func (m model) renderCertExpiry(expiry time.Time) string {
+	if expiry.IsZero() {
+		return "-"
+	}
+	left := time.Until(expiry)
+	switch {
+	case left <= 0:
+		return lipgloss.NewStyle().Foreground(lipgloss.Color("196")).Bold(true).Render("expired")
+	case left < 7*24*time.Hour:
+		return lipgloss.NewStyle().Foreground(lipgloss.Color("196")).Render("in " + formatDuration(left))
+	case left < 30*24*time.Hour:
+		return lipgloss.NewStyle().Foreground(lipgloss.Color("226")).Render("in " + formatDuration(left))
+	}
+	return "in " + formatDuration(left)
+}
+
+func (m model) renderHealth(status string, latency time.Duration, failures int) string {
+	switch status {
+	case "healthy":
+		style := lipgloss.NewStyle().Foreground(lipgloss.Color("46"))
+		return style.Render("✓ " + formatLatency(latency))
+	case "unhealthy":
+		style := lipgloss.NewStyle().Foreground(lipgloss.Color("196"))
+		return style.Render(fmt.Sprintf("✗ %d", failures))
+	default:
+		return "-"
+	}
+}
+
 func (m model) coloredActive(active int64) string {
 	style := lipgloss.NewStyle().
 		Foreground(lipgloss.Color("226"))
@@ -202,6 +586,59 @@ func (m model) coloredActive(active int64) string {
 	return style.Render(fmt.Sprintf("%d", active))
 }
 
+// coloredRejected highlights proxies that have turned clients away.
+func (m model) coloredRejected(rejected int64) string {
+	if rejected == 0 {
+		return "0"
+	}
+	style := lipgloss.NewStyle().Foreground(lipgloss.Color("214")).Bold(true)
+	return style.Render(fmt.Sprintf("%d", rejected))
+}
+
+// portLabel shows the listening port, the target port when it differs, and
+// the protocol for non-TCP proxies.
+func portLabel(stat *ProxyStats) string {
+	label := stat.Port
+	if stat.TargetPort != "" && stat.TargetPort != stat.Port {
+		label += "→" + stat.TargetPort
+	}
+	if stat.Protocol == "udp" {
+		label += "/udp"
+	}
+	return label
+}
+
+func formatDatagrams(stat *ProxyStats) string {
+	if stat.Protocol != "udp" {
+		return "-"
+	}
+	return fmt.Sprintf("%d", stat.Datagrams)
+}
+
+func formatLatency(d time.Duration) string {
+	if d < time.Millisecond {
+		return fmt.Sprintf("%dµs", d.Microseconds())
+	}
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	}
+	return fmt.Sprintf("%.1fs", d.Seconds())
+}
+
+// formatDuration shows a duration in its largest whole unit, e.g. 42s, 5m
+// or 3h.
+func formatDuration(d time.Duration) string {
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	}
+	return fmt.Sprintf("%dd", int(d.Hours()/24))
+}
+
 func tickCmd() tea.Cmd {
 	return tea.Tick(time.Second*2, func(t time.Time) tea.Msg {
 		return tickMsg(t)
@@ -221,6 +658,13 @@ func formatBytes(bytes int64) string {
 	return fmt.Sprintf("%.1fGB", float64(bytes)/(1024*1024*1024))
 }
 
+func formatRate(bytesPerSec float64) string {
+	if bytesPerSec < 1 {
+		return "-"
+	}
+	return formatBytes(int64(bytesPerSec)) + "/s"
+}
+
 func formatTime(t time.Time) string {
 	if t.IsZero() {
 		return "Never"
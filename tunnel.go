@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// The mutual TLS tunnel encrypts the hop between a forward and a reverse
+// instance. Both sides hold a certificate issued by the team CA from
+// `proxy cert`: the reverse listener requires one from every client and the
+// forward side presents its own while checking the listener's. Hostnames
+// aren't checked, since being signed by the team CA is what identifies a
+// peer, and the certificate's common name is shown per connection.
+var (
+	tunnelCA   string
+	tunnelCert string
+	tunnelKey  string
+)
+
+// tunnel holds the TLS settings for both ends of the tunnel.
+type tunnel struct {
+	listen *tls.Config // reverse side: requires a client certificate
+	dial   *tls.Config // forward side: presents ours, verifies theirs
+}
+
+// loadTunnel reads the team CA and this machine's certificate. It returns nil
+// when none of the tunnel flags are set.
+func loadTunnel(caPath, certPath, keyPath string) (*tunnel, error) {
+	if caPath == "" && certPath == "" && keyPath == "" {
+		return nil, nil
+	}
+	if caPath == "" || certPath == "" || keyPath == "" {
+		return nil, errors.New("--tunnel-ca, --tunnel-cert and --tunnel-key must be given together")
+	}
+
+	data, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tunnel CA: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in tunnel CA %s", caPath)
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tunnel certificate: %v", err)
+	}
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return nil, fmt.Errorf("tunnel certificate %s is not signed by the tunnel CA: %v", certPath, err)
+	}
+
+	return &tunnel{
+		listen: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    roots,
+			MinVersion:   tls.VersionTLS13,
+		},
+		dial: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			MinVersion:   tls.VersionTLS13,
+			// Verified against the team CA below, without a hostname
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				return verifyPeer(cs.PeerCertificates, roots)
+			},
+		},
+	}, nil
+}
+
+// verifyPeer checks that the reverse side's certificate chains to the team CA.
+func verifyPeer(certs []*x509.Certificate, roots *x509.CertPool) error {
+	if len(certs) == 0 {
+		return errors.New("no tunnel certificate from the reverse proxy")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+	if err != nil {
+		return fmt.Errorf("tunnel certificate of the reverse proxy: %v", err)
+	}
+	return nil
+}
+
+// tunnels reports whether cfg's connections between forward and reverse
+// instances go through the tunnel one by one. An entry with its own TLS
+// settings for that side, tls on a reverse listener or upstream_tls on a
+// forward one, uses those instead, and the mux session has its own tunnel.
+func (pm *ProxyManager) tunnels(cfg ProxyConfig) bool {
+	if pm.tunnel == nil || cfg.Protocol != "tcp" || cfg.NoTunnel || pm.muxes(cfg) {
+		return false
+	}
+	if pm.mode == "reverse" {
+		return cfg.TLS == nil
+	}
+	return cfg.UpstreamTLS == nil
+}
+
+// peerName is the common name of the certificate the other end of a TLS
+// connection or mux session presented, or empty.
+func peerName(conn net.Conn) string {
+	if st, ok := conn.(*muxStream); ok {
+		return st.session.peer
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpSessionTimeout is how long a UDP client may stay silent before its
+// upstream socket is closed and the session is forgotten, unless the entry
+// sets its own idle timeout.
+const udpSessionTimeout = 2 * time.Minute
+
+const maxDatagramSize = 64 * 1024
+
+// udpSession is the upstream socket dedicated to one client address. Replies
+// read from it are sent back to that client through the shared listener.
+type udpSession struct {
+	upstream   net.Conn
+	started    time.Time
+	lastActive atomic.Int64
+	bytesIn    atomic.Int64 // client to upstream
+	bytesOut   atomic.Int64 // upstream to client
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idleSince() time.Duration {
+	return time.Since(time.Unix(0, s.lastActive.Load()))
+}
+
+type udpRelay struct {
+	pm          *ProxyManager
+	key         string
+	port        string
+	stats       *ProxyStats
+	upstream    *UpstreamStats
+	listener    net.PacketConn
+	targetAddr  string
+	idleTimeout time.Duration
+	maxSessions int
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession
+}
+
+// serveUDP relays datagrams arriving on listenAddr to targetAddr, keeping one
+// upstream socket per client so replies find their way back.
+func (pm *ProxyManager) serveUDP(rp *runningProxy, listenAddr, targetAddr string) error {
+	cfg := rp.cfg
+	key := cfg.Key()
+
+	listener, err := net.ListenPacket("udp", listenAddr)
+	if err != nil {
+		pm.UpdateStats(key, "status", "Failed - Cannot bind")
+		return fmt.Errorf("failed to start UDP listener on %s: %v", listenAddr, err)
+	}
+	if !rp.setListener(listener) {
+		return nil
+	}
+	defer listener.Close()
+
+	// Config validation and the admin API only take upstreams for TCP, so a
+	// UDP proxy always has the one upstream for targetAddr
+	relay := &udpRelay{
+		pm:          pm,
+		key:         key,
+		port:        cfg.Port,
+		stats:       rp.stats,
+		upstream:    rp.upstreams[0].stats,
+		listener:    listener,
+		targetAddr:  targetAddr,
+		idleTimeout: cfg.IdleTimeout,
+		maxSessions: cfg.MaxConnections,
+		sessions:    make(map[string]*udpSession),
+	}
+	if relay.idleTimeout == 0 {
+		relay.idleTimeout = udpSessionTimeout
+	}
+	defer relay.closeAll()
+
+	done := make(chan struct{})
+	defer close(done)
+	go relay.expireSessions(done)
+
+	pm.UpdateStats(key, "status", "Active")
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, clientAddr, err := listener.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			slog.Warn("Failed to read datagram", "proxy", key, "error", err)
+			continue
+		}
+		if !cfg.allows(clientAddr) {
+			pm.UpdateStats(key, "rejected", int64(1))
+			continue
+		}
+
+		session, err := relay.session(clientAddr)
+		if err != nil {
+			slog.Warn("Failed to open UDP session", "proxy", key, "client", clientAddr, "target", targetAddr, "error", err)
+			continue
+		}
+
+		if _, err := session.upstream.Write(buf[:n]); err != nil {
+			slog.Warn("Error relaying datagram", "proxy", key, "target", targetAddr, "error", err)
+			continue
+		}
+		session.touch()
+		session.bytesIn.Add(int64(n))
+		atomic.AddInt64(&relay.stats.Datagrams, 1)
+		atomic.AddInt64(&relay.stats.BytesIn, int64(n))
+		relay.stats.touch()
+	}
+}
+
+// session returns the session for clientAddr, dialing a new upstream socket
+// the first time the client is seen. The dial happens without r.mu, so a
+// slow one doesn't hold up expiring or closing the other sessions.
+func (r *udpRelay) session(clientAddr net.Addr) (*udpSession, error) {
+	addr := clientAddr.String()
+	r.mu.Lock()
+	s, err := r.lookup(addr)
+	r.mu.Unlock()
+	if s != nil || err != nil {
+		return s, err
+	}
+
+	start := time.Now()
+	upstream, err := net.Dial("udp", r.targetAddr)
+	r.pm.recordDial(r.upstream, time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check again, since sessions may have come or gone during the dial
+	r.mu.Lock()
+	if s, err := r.lookup(addr); s != nil || err != nil {
+		r.mu.Unlock()
+		upstream.Close()
+		return s, err
+	}
+	s = &udpSession{upstream: upstream, started: time.Now()}
+	s.touch()
+	r.sessions[addr] = s
+	atomic.AddInt64(&r.stats.ActiveConnections, 1)
+	atomic.AddInt64(&r.upstream.ActiveConnections, 1)
+	r.mu.Unlock()
+
+	atomic.AddInt64(&r.upstream.TotalConnections, 1)
+	r.pm.UpdateStats(r.key, "total_connections", int64(1))
+
+	go r.replyLoop(clientAddr, s)
+	return s, nil
+}
+
+// lookup returns the session open for addr, or an error if there is none and
+// no room for another. r.mu must be held.
+func (r *udpRelay) lookup(addr string) (*udpSession, error) {
+	if s, ok := r.sessions[addr]; ok {
+		return s, nil
+	}
+	if r.maxSessions > 0 && len(r.sessions) >= r.maxSessions {
+		return nil, fmt.Errorf("limit of %d sessions reached", r.maxSessions)
+	}
+	return nil, nil
+}
+
+// replyLoop copies datagrams from the upstream back to the client until the
+// session's socket is closed.
+func (r *udpRelay) replyLoop(clientAddr net.Addr, s *udpSession) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("Error reading reply", "proxy", r.key, "target", r.targetAddr, "error", err)
+				r.remove(clientAddr.String(), s, closeError, err)
+			}
+			return
+		}
+
+		if _, err := r.listener.WriteTo(buf[:n], clientAddr); err != nil {
+			slog.Warn("Error relaying reply", "proxy", r.key, "client", clientAddr, "error", err)
+			continue
+		}
+		s.touch()
+		s.bytesOut.Add(int64(n))
+		atomic.AddInt64(&r.stats.Datagrams, 1)
+		atomic.AddInt64(&r.stats.BytesOut, int64(n))
+		r.stats.touch()
+	}
+}
+
+func (r *udpRelay) expireSessions(done <-chan struct{}) {
+	ticker := time.NewTicker(r.idleTimeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			r.mu.Lock()
+			var idle []string
+			for addr, s := range r.sessions {
+				if s.idleSince() > r.idleTimeout {
+					idle = append(idle, addr)
+				}
+			}
+			r.mu.Unlock()
+
+			for _, addr := range idle {
+				r.remove(addr, nil, closeIdle, nil)
+			}
+		}
+	}
+}
+
+// remove closes and forgets the session for addr, logging why it ended. If
+// expected is non-nil the session is only removed when it is still the one
+// registered for addr.
+func (r *udpRelay) remove(addr string, expected *udpSession, reason string, err error) {
+	r.mu.Lock()
+	s, ok := r.sessions[addr]
+	if !ok || (expected != nil && s != expected) {
+		r.mu.Unlock()
+		return
+	}
+	delete(r.sessions, addr)
+	r.mu.Unlock()
+
+	s.upstream.Close()
+	atomic.AddInt64(&r.stats.ActiveConnections, -1)
+	atomic.AddInt64(&r.upstream.ActiveConnections, -1)
+	r.logSession(addr, s, reason, err)
+}
+
+func (r *udpRelay) closeAll() {
+	r.mu.Lock()
+	addrs := make([]string, 0, len(r.sessions))
+	for addr := range r.sessions {
+		addrs = append(addrs, addr)
+	}
+	r.mu.Unlock()
+
+	for _, addr := range addrs {
+		r.remove(addr, nil, closeStopped, nil)
+	}
+}
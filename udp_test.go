@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPEcho answers every datagram with the same bytes and returns the
+// server's address.
+func startUDPEcho(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// freeUDPPort returns a UDP port nothing is listening on.
+func freeUDPPort(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, port, _ := net.SplitHostPort(conn.LocalAddr().String())
+	return port
+}
+
+// startUDPProxy relays a fresh local port to an echo server and returns the
+// manager, the proxy's address and its stats key.
+func startUDPProxy(t *testing.T, cfg ProxyConfig) (*ProxyManager, string, string) {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(startUDPEcho(t))
+	cfg.Host, cfg.TargetPort = host, port
+	cfg.Port = freeUDPPort(t)
+	cfg.Bind = "127.0.0.1"
+	cfg.Protocol = "udp"
+	pm := NewProxyManager()
+	pm.mode = "forward"
+	pm.startProxy(cfg)
+	t.Cleanup(func() { pm.stopProxy(cfg.Key(), true) })
+
+	addr := net.JoinHostPort("127.0.0.1", cfg.Port)
+
+	deadline := time.Now().Add(3 * time.Second)
+	for pm.GetStats()[cfg.Key()].Status != "Active" {
+		if time.Now().After(deadline) {
+			t.Fatal("UDP proxy never came up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return pm, addr, cfg.Key()
+}
+
+// udpExchange sends msg from a new client socket and returns the reply, or
+// "" if none arrives within wait.
+func udpExchange(t *testing.T, addr, msg string, wait time.Duration) string {
+	t.Helper()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+// activeSessions waits up to a few seconds for the proxy's session count to
+// reach want and returns the last count seen.
+func activeSessions(pm *ProxyManager, key string, want int64) int64 {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		got := pm.GetStats()[key].ActiveConnections
+		if got == want || time.Now().After(deadline) {
+			return got
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPSessionLimit(t *testing.T) {
+	pm, addr, key := startUDPProxy(t, ProxyConfig{IdleTimeout: time.Minute, MaxConnections: 1})
+
+	if got := udpExchange(t, addr, "first", time.Second); got != "first" {
+		t.Fatalf("first client got %q, want an echo", got)
+	}
+	if got := udpExchange(t, addr, "second", 200*time.Millisecond); got != "" {
+		t.Errorf("second client got %q past the session limit, want no reply", got)
+	}
+	if got := activeSessions(pm, key, 1); got != 1 {
+		t.Errorf("%d sessions, want 1", got)
+	}
+}
+
+func TestUDPSessionExpiry(t *testing.T) {
+	pm, addr, key := startUDPProxy(t, ProxyConfig{IdleTimeout: 100 * time.Millisecond, MaxConnections: 1})
+
+	if got := udpExchange(t, addr, "first", time.Second); got != "first" {
+		t.Fatalf("first client got %q, want an echo", got)
+	}
+
+	// Once the idle session expires its slot is free for another client
+	if got := activeSessions(pm, key, 0); got != 0 {
+		t.Fatalf("%d sessions after the idle timeout, want 0", got)
+	}
+	if got := udpExchange(t, addr, "second", time.Second); got != "second" {
+		t.Errorf("second client got %q after the first expired, want an echo", got)
+	}
+}